@@ -0,0 +1,99 @@
+package ftptest
+
+import (
+	"io"
+)
+
+// Transfer types set with TYPE
+const (
+	TypeASCII  = "A"
+	TypeBinary = "I"
+)
+
+// Writes LF line endings as CRLF, for downloads in ASCII mode. Existing
+// CRLF pairs are left alone.
+type crlfWriter struct {
+	writer io.Writer
+	lastCR bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	buffer := make([]byte, 0, len(p)+len(p)/16)
+
+	for _, b := range p {
+		if b == '\n' && !c.lastCR {
+			buffer = append(buffer, '\r')
+		}
+
+		buffer = append(buffer, b)
+		c.lastCR = b == '\r'
+	}
+
+	if _, err := c.writer.Write(buffer); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Writes CRLF line endings as LF, for uploads in ASCII mode. A CR at the end
+// of a chunk is held back until it is known whether LF follows.
+type lfWriter struct {
+	io.WriteCloser
+	pendingCR bool
+}
+
+func (l *lfWriter) Write(p []byte) (int, error) {
+	buffer := make([]byte, 0, len(p)+1)
+
+	for _, b := range p {
+		if l.pendingCR && b != '\n' {
+			buffer = append(buffer, '\r')
+		}
+
+		l.pendingCR = b == '\r'
+		if !l.pendingCR {
+			buffer = append(buffer, b)
+		}
+	}
+
+	if _, err := l.WriteCloser.Write(buffer); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (l *lfWriter) Close() error {
+	if l.pendingCR {
+		l.pendingCR = false
+
+		if _, err := l.WriteCloser.Write([]byte{'\r'}); err != nil {
+			l.WriteCloser.Close()
+			return err
+		}
+	}
+
+	return l.WriteCloser.Close()
+}
+
+// Counts bytes written to it
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.count += int64(len(p))
+	return len(p), nil
+}
+
+// Size of the content once its line endings are converted to CRLF
+func asciiSize(reader io.Reader) (int64, error) {
+	counter := &countingWriter{}
+
+	if _, err := io.Copy(&crlfWriter{writer: counter}, reader); err != nil {
+		return 0, err
+	}
+
+	return counter.count, nil
+}
@@ -0,0 +1,123 @@
+package ftptest
+
+import (
+	"bytes"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestCRLFWriter(t *testing.T) {
+	tests := map[string][]string{
+		"a\r\nb\r\n\r\n": {"a\nb\n\n"},
+		"a\r\nb\r\n":     {"a\r\nb\n"},
+		"a\r\n\r\n":      {"a\r", "\n\n"},
+		"a\rb":           {"a\rb"},
+	}
+
+	for want, chunks := range tests {
+		var buffer bytes.Buffer
+		writer := &crlfWriter{writer: &buffer}
+
+		for _, chunk := range chunks {
+			if n, err := writer.Write([]byte(chunk)); n != len(chunk) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+			}
+		}
+
+		if buffer.String() != want {
+			t.Errorf("%q written as %q, want %q", chunks, buffer.String(), want)
+		}
+	}
+}
+
+func TestLFWriter(t *testing.T) {
+	tests := map[string][]string{
+		"a\nb\n": {"a\r\nb\r\n"},
+		"a\nb":   {"a\r", "\nb"},
+		"a\rb\n": {"a\r", "b\n"},
+		"a\r":    {"a\r"},
+		"a\r\rb": {"a\r\r", "b"},
+		"a\n\n":  {"a\n", "\r\n"},
+		"bare\n": {"bare\n"},
+		"\r\n\n": {"\r", "\r\n", "\n"},
+	}
+
+	for want, chunks := range tests {
+		buffer := &bufferCloser{}
+		writer := &lfWriter{WriteCloser: buffer}
+
+		for _, chunk := range chunks {
+			if n, err := writer.Write([]byte(chunk)); n != len(chunk) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+			}
+		}
+		writer.Close()
+
+		if buffer.String() != want {
+			t.Errorf("%q written as %q, want %q", chunks, buffer.String(), want)
+		}
+	}
+}
+
+func TestASCIITransfers(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("a\nb\r\nc\n"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(200, "TYPE A")
+	if size := client.cmd(213, "SIZE file"); size != "9" {
+		t.Fatalf("SIZE in ASCII mode %s, want 9", size)
+	}
+
+	if got := client.download("RETR file"); string(got) != "a\r\nb\r\nc\r\n" {
+		t.Fatalf("RETR %q", got)
+	}
+
+	client.upload("STOR upload", []byte("x\r\ny\rz\r"))
+	client.upload("APPE upload", []byte("\r\nw\r\n"))
+	if got := readFile(t, server.Filesystem, "/upload"); got != "x\ny\rz\r\nw\n" {
+		t.Fatalf("upload stored as %q", got)
+	}
+
+	client.cmd(200, "TYPE I")
+	if size := client.cmd(213, "SIZE file"); size != "7" {
+		t.Fatalf("SIZE in binary mode %s, want 7", size)
+	}
+
+	if got := client.download("RETR file"); string(got) != "a\nb\r\nc\n" {
+		t.Fatalf("binary RETR %q", got)
+	}
+}
+
+func TestTypeReplies(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("a\n"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(200, "TYPE A N")
+	client.cmd(200, "TYPE L 8")
+	client.cmd(504, "TYPE E")
+	client.cmd(501, "TYPE")
+	client.cmd(501, "TYPE X")
+
+	// The size changes with the conversion, so ASCII RETR does not announce it
+	client.cmd(200, "TYPE A")
+
+	socket := client.passive()
+	defer socket.Close()
+
+	if message := client.cmd(150, "RETR file"); message != "Data transfer starting" {
+		t.Fatalf("150 reply %q", message)
+	}
+}
@@ -0,0 +1,51 @@
+package ftptest
+
+// Identity of an authenticated user. Home and Permissions, if set, take
+// precedence over the ones configured on the server.
+type Identity struct {
+	Name        string
+	Home        string
+	Permissions *Permissions
+}
+
+// Authenticator verifies the credentials sent with USER and PASS
+type Authenticator interface {
+	Authenticate(user, pass string) (Identity, error)
+}
+
+// Accepts any credentials, used when no authenticator is configured
+type AcceptAuthenticator struct{}
+
+func (a AcceptAuthenticator) Authenticate(user, pass string) (Identity, error) {
+	return Identity{Name: user}, nil
+}
+
+// Maps user names to their passwords
+type StaticAuthenticator map[string]string
+
+func (s StaticAuthenticator) Authenticate(user, pass string) (Identity, error) {
+	password, ok := s[user]
+	if !ok || password != pass {
+		return Identity{}, ErrAuthenticationFailed
+	}
+
+	return Identity{Name: user}, nil
+}
+
+// Only lets in the "anonymous" and "ftp" users, with any password
+type AnonymousAuthenticator struct{}
+
+func (a AnonymousAuthenticator) Authenticate(user, pass string) (Identity, error) {
+	if user != "anonymous" && user != "ftp" {
+		return Identity{}, ErrAuthenticationFailed
+	}
+
+	return Identity{Name: user}, nil
+}
+
+// Rejects every login attempt
+type RejectAuthenticator struct{}
+
+func (r RejectAuthenticator) Authenticate(user, pass string) (Identity, error) {
+	return Identity{}, ErrAuthenticationFailed
+}
@@ -0,0 +1,83 @@
+package ftptest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStaticAuthenticator(t *testing.T) {
+	server := NewServer(t, WithAuthenticator(StaticAuthenticator{"alice": "secret"}))
+
+	client := dialServer(t, server)
+	client.cmd(331, "USER alice")
+	client.cmd(530, "PASS wrong")
+	client.cmd(530, "PWD")
+
+	client.cmd(331, "USER bob")
+	client.cmd(530, "PASS secret")
+
+	client.loginAs("alice", "secret")
+	client.cmd(257, "PWD")
+}
+
+func TestAnonymousAuthenticator(t *testing.T) {
+	server := NewServer(t, WithAuthenticator(AnonymousAuthenticator{}))
+
+	client := dialServer(t, server)
+	client.cmd(331, "USER alice")
+	client.cmd(530, "PASS secret")
+	client.loginAs("anonymous", "guest@example.com")
+}
+
+func TestRejectAuthenticator(t *testing.T) {
+	server := NewServer(t, WithAuthenticator(RejectAuthenticator{}))
+
+	client := dialServer(t, server)
+	client.cmd(331, "USER alice")
+	client.cmd(530, "PASS secret")
+}
+
+func TestPassWithoutUser(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.cmd(503, "PASS secret")
+
+	// A failed login does not keep the user name around either
+	client.login()
+	client.cmd(220, "REIN")
+	client.cmd(503, "PASS test")
+	client.cmd(530, "PWD")
+}
+
+func TestHomeDirectory(t *testing.T) {
+	server := NewServer(t, WithHome("alice", "/home/alice"))
+	server.Filesystem.MkDir("/home")
+	server.Filesystem.MkDir("/home/alice")
+	server.Filesystem.WriteFile("/secret", []byte("root only"))
+
+	client := dialServer(t, server)
+	client.loginAs("alice", "secret")
+
+	if message := client.cmd(257, "PWD"); !strings.Contains(message, `"/"`) {
+		t.Fatalf("PWD %q", message)
+	}
+
+	// ".." can not leave the jail
+	client.cmd(250, "CWD ..")
+	client.upload("STOR ../../upload", []byte("data"))
+
+	if got := readFile(t, server.Filesystem, "/home/alice/upload"); got != "data" {
+		t.Fatalf("upload stored as %q", got)
+	}
+
+	client.cmd(450, "SIZE /secret")
+}
+
+func TestMissingHomeDirectory(t *testing.T) {
+	server := NewServer(t, WithHome("alice", "/home/alice"))
+
+	client := dialServer(t, server)
+	client.cmd(331, "USER alice")
+	client.cmd(530, "PASS secret")
+}
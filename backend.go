@@ -0,0 +1,78 @@
+package ftptest
+
+import (
+	"io"
+	"os"
+)
+
+// Backend stores the files served to clients. Paths are absolute and use
+// forward slashes. CreateAt keeps the first offset bytes of the file and
+// replaces the rest with what is written, it is used by REST and APPE.
+type Backend interface {
+	MkDir(path string) error
+	RmDir(path string) error
+	Open(path string) (io.ReadSeekCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	CreateAt(path string, offset int64) (io.WriteCloser, error)
+	Stat(path string) (*File, error)
+	List(path string) ([]*File, error)
+	Rename(from string, to string) error
+	Remove(path string) error
+}
+
+// Backends that support changing permissions, required by SITE CHMOD
+type Chmoder interface {
+	Chmod(path string, mode os.FileMode) error
+}
+
+// Aborter is implemented by the writers of Create and CreateAt that can
+// discard an upload, so a failed transfer leaves the existing file alone
+type Aborter interface {
+	Abort() error
+}
+
+// Discards a failed upload, writers that cannot abort are closed
+func abortWriter(writer io.WriteCloser) error {
+	if aborter, ok := writer.(Aborter); ok {
+		return aborter.Abort()
+	}
+
+	return writer.Close()
+}
+
+// Directory exists in the backend?
+func dirExists(backend Backend, path string) error {
+	file, err := backend.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if file.Type != "directory" {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Stat a regular file, directories are reported as not found
+func statFile(backend Backend, path string) (*File, error) {
+	file, err := backend.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if file.Type != "file" {
+		return nil, ErrNotFound
+	}
+
+	return file, nil
+}
+
+var (
+	_ Backend = (*Filesystem)(nil)
+	_ Backend = (*DirBackend)(nil)
+	_ Chmoder = (*Filesystem)(nil)
+	_ Chmoder = (*DirBackend)(nil)
+	_ Aborter = (*fileWriter)(nil)
+	_ Aborter = (*dirWriter)(nil)
+)
@@ -0,0 +1,188 @@
+package ftptest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Minimal FTP client driving the server in tests. Replies with another code
+// than expected fail the test.
+type testClient struct {
+	t    testing.TB
+	conn net.Conn
+	text *textproto.Conn
+
+	// Message of the 220 reply
+	greeting string
+
+	// Data connections are wrapped in TLS when set, after PROT P
+	dataTLS *tls.Config
+}
+
+// Connects to the server and reads the greeting
+func dialServer(t testing.TB, server *FTPServer) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	return newTestClient(t, conn)
+}
+
+func newTestClient(t testing.TB, conn net.Conn) *testClient {
+	t.Helper()
+
+	client := &testClient{t: t, conn: conn, text: textproto.NewConn(conn)}
+	t.Cleanup(func() {
+		client.conn.Close()
+	})
+
+	client.greeting = client.expect(220)
+	return client
+}
+
+// Sends a command and returns the message of the reply
+func (c *testClient) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		c.t.Fatalf("send %q: %v", fmt.Sprintf(format, args...), err)
+	}
+
+	return c.expect(code)
+}
+
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+
+	got, message, err := c.text.ReadResponse(0)
+	if got != code {
+		c.t.Fatalf("expected %d, got %d %q (%v)", code, got, message, err)
+	}
+
+	return message
+}
+
+func (c *testClient) login() {
+	c.t.Helper()
+
+	c.loginAs("test", "test")
+}
+
+func (c *testClient) loginAs(user string, pass string) {
+	c.t.Helper()
+
+	c.cmd(331, "USER %s", user)
+	c.cmd(230, "PASS %s", pass)
+}
+
+// Upgrades the control connection with AUTH TLS
+func (c *testClient) startTLS(config *tls.Config) {
+	c.t.Helper()
+
+	c.cmd(234, "AUTH TLS")
+	c.conn = tls.Client(c.conn, config)
+	c.text = textproto.NewConn(c.conn)
+}
+
+// Opens a data connection with EPSV
+func (c *testClient) passive() net.Conn {
+	c.t.Helper()
+
+	message := c.cmd(229, "EPSV")
+
+	var port int
+	start := strings.Index(message, "|||")
+	if start < 0 {
+		c.t.Fatalf("invalid EPSV reply %q", message)
+	}
+	fmt.Sscanf(message[start+3:], "%d|", &port)
+
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	data, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		c.t.Fatalf("dial data: %v", err)
+	}
+
+	if c.dataTLS != nil {
+		return tls.Client(data, c.dataTLS)
+	}
+
+	return data
+}
+
+// Sends data with an upload command such as STOR, returns the 226 message
+func (c *testClient) upload(command string, data []byte) string {
+	c.t.Helper()
+
+	socket := c.passive()
+	message := c.cmd(150, "%s", command)
+
+	if _, err := socket.Write(data); err != nil {
+		c.t.Fatalf("write data: %v", err)
+	}
+	socket.Close()
+
+	c.expect(226)
+	return message
+}
+
+// Reads the data of a download or listing command such as RETR
+func (c *testClient) download(command string) []byte {
+	c.t.Helper()
+
+	socket := c.passive()
+	c.cmd(150, "%s", command)
+
+	data, err := io.ReadAll(socket)
+	if err != nil {
+		c.t.Fatalf("read data: %v", err)
+	}
+	socket.Close()
+
+	c.expect(226)
+	return data
+}
+
+// Certificate for the server and a client config trusting it
+func testCertificate(t testing.TB) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	certificate, err := GenerateCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.Leaf)
+
+	server := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	client := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+// Content of a file in the in-memory filesystem
+func readFile(t testing.TB, filesystem *Filesystem, path string) string {
+	t.Helper()
+
+	reader, err := filesystem.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+
+	return string(data)
+}
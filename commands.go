@@ -3,7 +3,10 @@ package ftptest
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
+	"os"
+	filepath "path"
 	"strconv"
 	"strings"
 
@@ -14,34 +17,47 @@ import (
 type Command interface {
 	RequiresParams() bool
 	RequiresAuth() bool
+	Permission() Permission
 	Execute(conn *Connection, args string) error
 }
 
 // Commands map
 var commands = map[string]Command{
 	"ALLO": &commandALLO{},
+	"APPE": &commandAPPE{},
+	"AUTH": &commandAUTH{},
 	"CDUP": &commandCDUP{},
 	"CWD":  &commandCWD{},
 	"DELE": &commandDELE{},
 	"EPRT": &commandEPRT{},
 	"EPSV": &commandEPSV{},
+	"FEAT": &commandFEAT{},
 	"LIST": &commandLIST{},
 	"NLST": &commandNLST{},
 	"MDTM": &commandMDTM{},
 	"MKD":  &commandMKD{},
+	"MLSD": &commandMLSD{},
+	"MLST": &commandMLST{},
 	"MODE": &commandMODE{},
 	"NOOP": &commandNOOP{},
+	"OPTS": &commandOPTS{},
 	"PASS": &commandPASS{},
 	"PASV": &commandPASV{},
+	"PBSZ": &commandPBSZ{},
 	"PORT": &commandPORT{},
+	"PROT": &commandPROT{},
 	"PWD":  &commandPWD{},
 	"QUIT": &commandQUIT{},
+	"REIN": &commandREIN{},
+	"REST": &commandREST{},
 	"RETR": &commandRETR{},
 	"RNFR": &commandRNFR{},
 	"RNTO": &commandRNTO{},
 	"RMD":  &commandRMD{},
+	"SITE": &commandSITE{},
 	"SIZE": &commandSIZE{},
 	"STOR": &commandSTOR{},
+	"STOU": &commandSTOU{},
 	"STRU": &commandSTRU{},
 	"SYST": &commandSYST{},
 	"TYPE": &commandTYPE{},
@@ -63,11 +79,91 @@ func (c *commandALLO) RequiresAuth() bool {
 	return false
 }
 
+func (c *commandALLO) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandALLO) Execute(conn *Connection, args string) error {
 	conn.WriteMessage(202, "Obsolete")
 	return nil
 }
 
+// APPE appends to a file, creating it when missing
+type commandAPPE struct{}
+
+func (c *commandAPPE) RequiresParams() bool {
+	return true
+}
+
+func (c *commandAPPE) RequiresAuth() bool {
+	return true
+}
+
+func (c *commandAPPE) Permission() Permission {
+	return PermWrite
+}
+
+func (c *commandAPPE) Execute(conn *Connection, args string) error {
+	conn.takeRestartOffset()
+
+	if !conn.checkDataConnection() {
+		return nil
+	}
+
+	path := conn.BuildPath(args)
+
+	var offset int64
+	if file, err := statFile(conn.Filesystem, path); err == nil {
+		offset = file.Size
+	}
+
+	writer, err := conn.Filesystem.CreateAt(path, offset)
+	if err != nil {
+		conn.WriteMessage(550, "Action not taken")
+		return nil
+	}
+
+	receiveData(conn, writer, "")
+	return nil
+}
+
+// AUTH upgrades the control connection to TLS
+type commandAUTH struct{}
+
+func (c *commandAUTH) RequiresParams() bool {
+	return true
+}
+
+func (c *commandAUTH) RequiresAuth() bool {
+	return false
+}
+
+func (c *commandAUTH) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandAUTH) Execute(conn *Connection, args string) error {
+	if conn.Server.TLSConfig == nil {
+		conn.WriteMessage(502, "TLS is not configured")
+		return nil
+	}
+
+	if conn.Secure {
+		conn.WriteMessage(503, "Already using TLS")
+		return nil
+	}
+
+	mechanism := strings.ToUpper(args)
+	if mechanism != "TLS" && mechanism != "TLS-C" && mechanism != "SSL" {
+		conn.WriteMessage(504, "Unsupported security mechanism")
+		return nil
+	}
+
+	conn.WriteMessage(234, "AUTH "+mechanism+" successful")
+	conn.upgradeToTLS(conn.Server.TLSConfig)
+	return nil
+}
+
 // CDUP goes to the parent directory.
 type commandCDUP struct{}
 
@@ -79,6 +175,10 @@ func (c *commandCDUP) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandCDUP) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandCDUP) Execute(conn *Connection, args string) error {
 	cmd := &commandCWD{}
 	return cmd.Execute(conn, "..")
@@ -95,6 +195,10 @@ func (c *commandCWD) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandCWD) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandCWD) Execute(conn *Connection, args string) error {
 	err := conn.ChangeWorkingDirectory(args)
 	if err != nil {
@@ -116,6 +220,10 @@ func (c *commandDELE) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandDELE) Permission() Permission {
+	return PermDelete
+}
+
 func (c *commandDELE) Execute(conn *Connection, args string) error {
 	path := conn.BuildPath(args)
 	err := conn.Filesystem.Remove(path)
@@ -138,42 +246,55 @@ func (c *commandEPRT) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandEPRT) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandEPRT) Execute(conn *Connection, args string) error {
+	// Arguments look like |1|127.0.0.1|6446|, the delimiter is the first character
 	delimiter := string(args[0:1])
 	parts := strings.Split(args, delimiter)
 
-	if len(parts) != 4 {
-		return ErrInvalidMessage
+	if len(parts) != 5 {
+		conn.WriteMessage(501, "Invalid EPRT arguments")
+		return nil
 	}
 
 	addressFamily, err := strconv.Atoi(parts[1])
 	if err != nil {
-		return err
+		conn.WriteMessage(501, "Invalid EPRT arguments")
+		return nil
 	}
 
-	if addressFamily != 1 && addressFamily != 2 {
-		return ErrProtocolNotSupported
+	host := parts[2]
+	ip := net.ParseIP(host)
+
+	// 1 is IPv4, 2 is IPv6 and the address has to match the family
+	if (addressFamily != 1 && addressFamily != 2) || ip == nil || (ip.To4() != nil) != (addressFamily == 1) {
+		conn.WriteMessage(522, "Network protocol not supported, use (1,2)")
+		return nil
 	}
 
-	host := parts[2]
 	port, err := strconv.Atoi(parts[3])
-	if err != nil {
-		return err
+	if err != nil || port < 1 || port > 65535 {
+		conn.WriteMessage(501, "Invalid EPRT arguments")
+		return nil
 	}
 
-	socket, err := NewActiveSocket(host, port)
+	socket, err := NewActiveSocket(host, port, conn.Server.DataTimeout, conn.dataTLSConfig())
 	if err != nil {
-		return err
+		conn.WriteMessage(425, "Data connection failed")
+		return nil
 	}
 
-	conn.DataSocket = socket
+	conn.SetDataSocket(socket)
 
 	conn.WriteMessage(200, "Connection estabilished ("+parts[3]+")")
 	return nil
 }
 
-// EPSV is a modern version of the PASV command that includes IPv6 support,
-// which is not supported in FTPTest
+// EPSV is a modern version of the PASV command that includes IPv6 support.
+// The socket listens on the same address family as the control connection.
 type commandEPSV struct{}
 
 func (c *commandEPSV) RequiresParams() bool {
@@ -184,15 +305,55 @@ func (c *commandEPSV) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandEPSV) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandEPSV) Execute(conn *Connection, args string) error {
-	socket, err := NewPassiveSocket()
+	family := "1"
+	if conn.isIPv6() {
+		family = "2"
+	}
+
+	switch strings.ToUpper(args) {
+	case "", family:
+	case "ALL":
+		conn.WriteMessage(200, "EPSV ALL ok")
+		return nil
+	default:
+		conn.WriteMessage(522, "Network protocol not supported, use ("+family+")")
+		return nil
+	}
+
+	socket, err := NewPassiveSocket(conn.passiveConfig())
 	if err != nil {
-		return err
+		conn.WriteMessage(425, "Can't open data connection: "+err.Error())
+		return nil
 	}
 
-	conn.DataSocket = socket
+	conn.SetDataSocket(socket)
+
+	conn.WriteMessage(229, "Entering Extended Passive Mode (|||"+strconv.Itoa(socket.GetPort())+"|)")
+	return nil
+}
+
+// FEAT lists the extensions the server supports
+type commandFEAT struct{}
+
+func (c *commandFEAT) RequiresParams() bool {
+	return false
+}
+
+func (c *commandFEAT) RequiresAuth() bool {
+	return false
+}
+
+func (c *commandFEAT) Permission() Permission {
+	return PermNone
+}
 
-	conn.WriteMessage(200, "Entering Extended Passive Mode (|||"+strconv.Itoa(socket.GetPort())+"|)")
+func (c *commandFEAT) Execute(conn *Connection, args string) error {
+	conn.WriteListMessage(211, "Extensions supported:", conn.featureList(), "End")
 	return nil
 }
 
@@ -207,20 +368,27 @@ func (c *commandLIST) RequiresAuth() bool {
 	return true
 }
 
-func (c *commandLIST) Execute(conn *Connection, args string) error {
-	conn.WriteMessage(150, "Opening ASCII mode data connection for file list")
+func (c *commandLIST) Permission() Permission {
+	return PermList
+}
 
-	path := conn.BuildPath(args)
+func (c *commandLIST) Execute(conn *Connection, args string) error {
+	if !conn.checkDataConnection() {
+		return nil
+	}
 
-	contents, err := conn.Filesystem.DirContents(path)
+	contents, err := conn.Filesystem.List(conn.BuildPath(listArgs(args)))
 	if err != nil {
-		contents = make([]*File, 0)
+		conn.WriteMessage(550, "Directory not available")
+		return nil
 	}
 
+	conn.WriteMessage(150, "Opening ASCII mode data connection for file list")
+
 	var buffer bytes.Buffer
 	for _, file := range contents {
 		buffer.WriteString(
-			file.ModeString() + " 1 owner group" +
+			file.ModeString() + " 1 " + file.Owner + " " + file.Group +
 				lpad(strconv.Itoa(int(file.Size)), 12) + " " +
 				strftime.Format("%b %d %H:%M", file.TimeModified) + " " +
 				file.Name + "\r\n",
@@ -233,6 +401,17 @@ func (c *commandLIST) Execute(conn *Connection, args string) error {
 	return nil
 }
 
+// Drops the ls style options, e.g. "-la", that clients send with LIST and
+// NLST
+func listArgs(args string) string {
+	for strings.HasPrefix(args, "-") {
+		_, args, _ = strings.Cut(args, " ")
+		args = strings.TrimLeft(args, " ")
+	}
+
+	return args
+}
+
 // NLST returns a list of filenames in CWD
 type commandNLST struct{}
 
@@ -244,16 +423,23 @@ func (c *commandNLST) RequiresAuth() bool {
 	return true
 }
 
-func (c *commandNLST) Execute(conn *Connection, args string) error {
-	conn.WriteMessage(150, "Opening ASCII mode data connection for file list")
+func (c *commandNLST) Permission() Permission {
+	return PermList
+}
 
-	path := conn.BuildPath(args)
+func (c *commandNLST) Execute(conn *Connection, args string) error {
+	if !conn.checkDataConnection() {
+		return nil
+	}
 
-	contents, err := conn.Filesystem.DirContents(path)
+	contents, err := conn.Filesystem.List(conn.BuildPath(listArgs(args)))
 	if err != nil {
-		contents = make([]*File, 0)
+		conn.WriteMessage(550, "Directory not available")
+		return nil
 	}
 
+	conn.WriteMessage(150, "Opening ASCII mode data connection for file list")
+
 	var buffer bytes.Buffer
 	for _, file := range contents {
 		buffer.WriteString(
@@ -267,7 +453,7 @@ func (c *commandNLST) Execute(conn *Connection, args string) error {
 	return nil
 }
 
-// MDTM returns time when the file was last modified
+// MDTM returns time when the file or directory was last modified
 type commandMDTM struct{}
 
 func (c *commandMDTM) RequiresParams() bool {
@@ -278,12 +464,16 @@ func (c *commandMDTM) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandMDTM) Permission() Permission {
+	return PermList
+}
+
 func (c *commandMDTM) Execute(conn *Connection, args string) error {
 	path := conn.BuildPath(args)
 
-	time, err := conn.Filesystem.LastModified(path)
+	file, err := conn.Filesystem.Stat(path)
 	if err == nil {
-		conn.WriteMessage(213, strftime.Format("%Y%m%d%H%M%S", time))
+		conn.WriteMessage(213, strftime.Format("%Y%m%d%H%M%S", file.TimeModified.UTC()))
 	} else {
 		conn.WriteMessage(450, "File not available")
 	}
@@ -302,6 +492,10 @@ func (c *commandMKD) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandMKD) Permission() Permission {
+	return PermMkDir
+}
+
 func (c *commandMKD) Execute(conn *Connection, args string) error {
 	path := conn.BuildPath(args)
 
@@ -314,7 +508,76 @@ func (c *commandMKD) Execute(conn *Connection, args string) error {
 	return nil
 }
 
-// MODE sets the socket transmission mode
+// MLSD sends a machine readable listing of a directory (RFC 3659)
+type commandMLSD struct{}
+
+func (c *commandMLSD) RequiresParams() bool {
+	return false
+}
+
+func (c *commandMLSD) RequiresAuth() bool {
+	return true
+}
+
+func (c *commandMLSD) Permission() Permission {
+	return PermList
+}
+
+func (c *commandMLSD) Execute(conn *Connection, args string) error {
+	if !conn.checkDataConnection() {
+		return nil
+	}
+
+	virtual := conn.VirtualPath(args)
+
+	contents, err := conn.Filesystem.List(conn.RealPath(virtual))
+	if err != nil {
+		conn.WriteMessage(550, "Directory not available")
+		return nil
+	}
+
+	conn.WriteMessage(150, "Opening ASCII mode data connection for MLSD")
+
+	var buffer bytes.Buffer
+	for _, file := range contents {
+		entry := conn.mlstEntry(file, filepath.Join(virtual, file.Name), file.Name)
+		buffer.WriteString(entry + "\r\n")
+	}
+
+	conn.SendDataThroughSocket(buffer.String())
+	return nil
+}
+
+// MLST sends machine readable facts about a file on the control connection
+type commandMLST struct{}
+
+func (c *commandMLST) RequiresParams() bool {
+	return false
+}
+
+func (c *commandMLST) RequiresAuth() bool {
+	return true
+}
+
+func (c *commandMLST) Permission() Permission {
+	return PermList
+}
+
+func (c *commandMLST) Execute(conn *Connection, args string) error {
+	virtual := conn.VirtualPath(args)
+
+	file, err := conn.Filesystem.Stat(conn.RealPath(virtual))
+	if err != nil {
+		conn.WriteMessage(550, "File not available")
+		return nil
+	}
+
+	entry := conn.mlstEntry(file, virtual, virtual)
+	conn.WriteListMessage(250, "Listing "+virtual, []string{entry}, "End")
+	return nil
+}
+
+// MODE sets the socket transmission mode, stream or deflate compressed
 type commandMODE struct{}
 
 func (c commandMODE) RequiresParams() bool {
@@ -325,11 +588,20 @@ func (c commandMODE) RequiresAuth() bool {
 	return true
 }
 
+func (c commandMODE) Permission() Permission {
+	return PermNone
+}
+
 func (c commandMODE) Execute(conn *Connection, args string) error {
-	if strings.ToUpper(args) == "S" {
+	switch strings.ToUpper(args) {
+	case ModeStream:
+		conn.TransferMode = ModeStream
 		conn.WriteMessage(200, "OK")
-	} else {
-		conn.WriteMessage(504, "MODE is an obsolete command")
+	case ModeDeflate:
+		conn.TransferMode = ModeDeflate
+		conn.WriteMessage(200, "MODE Z ok")
+	default:
+		conn.WriteMessage(504, "MODE not supported")
 	}
 
 	return nil
@@ -346,12 +618,77 @@ func (c *commandNOOP) RequiresAuth() bool {
 	return false
 }
 
+func (c *commandNOOP) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandNOOP) Execute(conn *Connection, args string) error {
 	conn.WriteMessage(200, "OK")
 	return nil
 }
 
-// PASS placeholder command. Processes the password.
+// Options set through OPTS, by the command they belong to
+var commandOptions = map[string]func(conn *Connection, args string) error{
+	"MLST": optsMLST,
+	"MODE": optsMODE,
+	"UTF8": optsUTF8,
+}
+
+// OPTS sets options of other commands
+type commandOPTS struct{}
+
+func (c *commandOPTS) RequiresParams() bool {
+	return true
+}
+
+func (c *commandOPTS) RequiresAuth() bool {
+	return false
+}
+
+func (c *commandOPTS) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandOPTS) Execute(conn *Connection, args string) error {
+	parts := strings.SplitN(args, " ", 2)
+
+	name := strings.ToUpper(parts[0])
+
+	handler, ok := commandOptions[name]
+	if !ok || !conn.Server.commandEnabled(name) {
+		conn.WriteMessage(501, "Option not understood")
+		return nil
+	}
+
+	if len(parts) == 1 {
+		return handler(conn, "")
+	}
+
+	return handler(conn, strings.TrimSpace(parts[1]))
+}
+
+// OPTS MLST selects the facts sent by MLST and MLSD
+func optsMLST(conn *Connection, args string) error {
+	facts := conn.selectMLSTFacts(args)
+	conn.WriteMessage(200, "MLST OPTS "+joinMLSTFacts(facts))
+	return nil
+}
+
+// OPTS UTF8 ON, paths are always sent as UTF-8 so it can not be turned off
+func optsUTF8(conn *Connection, args string) error {
+	switch strings.ToUpper(args) {
+	case "ON":
+		conn.WriteMessage(200, "Always in UTF8 mode")
+	case "OFF":
+		conn.WriteMessage(504, "UTF8 can not be turned off")
+	default:
+		conn.WriteMessage(501, "Invalid UTF8 option")
+	}
+
+	return nil
+}
+
+// PASS checks the password of the user sent with USER
 type commandPASS struct{}
 
 func (c *commandPASS) RequiresParams() bool {
@@ -362,8 +699,35 @@ func (c *commandPASS) RequiresAuth() bool {
 	return false
 }
 
+func (c *commandPASS) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandPASS) Execute(conn *Connection, args string) error {
-	conn.Authenticated = true
+	if conn.Server.RequireTLS && !conn.Secure {
+		conn.WriteMessage(534, "Policy requires TLS, use AUTH TLS first")
+		return nil
+	}
+
+	if conn.User == "" {
+		conn.WriteMessage(503, "Bad sequence of commands, send USER first")
+		return nil
+	}
+
+	user := conn.User
+	conn.User = ""
+
+	identity, err := conn.Server.Authenticator.Authenticate(user, args)
+	if err != nil {
+		conn.WriteMessage(530, "Login incorrect")
+		return nil
+	}
+
+	if err := conn.login(identity); err != nil {
+		conn.WriteMessage(530, "Home directory not available")
+		return nil
+	}
+
 	conn.WriteMessage(230, "Password ok, continue")
 	return nil
 }
@@ -379,26 +743,63 @@ func (c *commandPASV) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandPASV) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandPASV) Execute(conn *Connection, args string) error {
-	socket, err := NewPassiveSocket()
+	socket, err := NewPassiveSocket(conn.passiveConfig())
 	if err != nil {
-		conn.WriteMessage(425, "Data connection failed")
+		conn.WriteMessage(425, "Can't open data connection: "+err.Error())
+		return nil
+	}
+
+	// The reply can only describe IPv4 addresses
+	ip := resolveIPv4(socket.GetHost())
+	if ip == nil {
+		socket.Close()
+		conn.WriteMessage(425, "PASV requires IPv4, use EPSV")
 		return nil
 	}
 
-	conn.DataSocket = socket
+	conn.SetDataSocket(socket)
 
 	p1 := socket.GetPort() / 256
 	p2 := socket.GetPort() - (p1 * 256)
 
-	quads := strings.Split(socket.GetHost(), ".")
-	target := fmt.Sprintf("(%s,%s,%s,%s,%d,%d)", quads[0], quads[1], quads[2], quads[3], p1, p2)
+	target := fmt.Sprintf("(%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], p1, p2)
 	msg := "Entering Passive Mode " + target
 
 	conn.WriteMessage(227, msg)
 	return nil
 }
 
+// PBSZ sets the protection buffer size, which is always 0 for TLS
+type commandPBSZ struct{}
+
+func (c *commandPBSZ) RequiresParams() bool {
+	return true
+}
+
+func (c *commandPBSZ) RequiresAuth() bool {
+	return false
+}
+
+func (c *commandPBSZ) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandPBSZ) Execute(conn *Connection, args string) error {
+	if !conn.Secure {
+		conn.WriteMessage(503, "PBSZ requires AUTH first")
+		return nil
+	}
+
+	conn.BufferSizeSet = true
+	conn.WriteMessage(200, "PBSZ=0")
+	return nil
+}
+
 // PORT starts a new active mode connection
 type commandPORT struct{}
 
@@ -410,8 +811,16 @@ func (c commandPORT) RequiresAuth() bool {
 	return true
 }
 
+func (c commandPORT) Permission() Permission {
+	return PermNone
+}
+
 func (c commandPORT) Execute(conn *Connection, args string) error {
 	nums := strings.Split(args, ",")
+	if len(nums) != 6 {
+		conn.WriteMessage(501, "Invalid PORT arguments")
+		return nil
+	}
 
 	portOne, _ := strconv.Atoi(nums[4])
 	portTwo, _ := strconv.Atoi(nums[5])
@@ -420,20 +829,57 @@ func (c commandPORT) Execute(conn *Connection, args string) error {
 	host := nums[0] + "." + nums[1] + "." + nums[2] + "." + nums[3]
 
 	if host == "127.0.0.1" {
-		host = strings.Split(conn.Connection.RemoteAddr().String(), ":")[0]
+		host, _, _ = net.SplitHostPort(conn.Connection.RemoteAddr().String())
 	}
 
-	socket, err := NewActiveSocket(host, port)
+	socket, err := NewActiveSocket(host, port, conn.Server.DataTimeout, conn.dataTLSConfig())
 	if err != nil {
 		conn.WriteMessage(425, "Data connection failed")
 		return nil
 	}
 
-	conn.DataSocket = socket
+	conn.SetDataSocket(socket)
 	conn.WriteMessage(200, "Connection established ("+strconv.Itoa(port)+")")
 	return nil
 }
 
+// PROT selects whether data connections use TLS
+type commandPROT struct{}
+
+func (c *commandPROT) RequiresParams() bool {
+	return true
+}
+
+func (c *commandPROT) RequiresAuth() bool {
+	return false
+}
+
+func (c *commandPROT) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandPROT) Execute(conn *Connection, args string) error {
+	if !conn.Secure || !conn.BufferSizeSet {
+		conn.WriteMessage(503, "PROT requires AUTH and PBSZ first")
+		return nil
+	}
+
+	switch strings.ToUpper(args) {
+	case "C":
+		conn.ProtectedData = false
+		conn.WriteMessage(200, "Protection level set to Clear")
+	case "P":
+		conn.ProtectedData = true
+		conn.WriteMessage(200, "Protection level set to Private")
+	case "S", "E":
+		conn.WriteMessage(536, "Protection level not supported")
+	default:
+		conn.WriteMessage(504, "Unknown protection level")
+	}
+
+	return nil
+}
+
 // PWD tells the client current working directory
 type commandPWD struct{}
 
@@ -445,6 +891,10 @@ func (c *commandPWD) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandPWD) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandPWD) Execute(conn *Connection, args string) error {
 	conn.WriteMessage(257, "\""+conn.WorkingDirectory+"\" is the current directory")
 	return nil
@@ -461,10 +911,62 @@ func (c *commandQUIT) RequiresAuth() bool {
 	return false
 }
 
+func (c *commandQUIT) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandQUIT) Execute(conn *Connection, args string) error {
 	return ErrQuitRequest
 }
 
+// REIN logs the user out and resets the session
+type commandREIN struct{}
+
+func (c *commandREIN) RequiresParams() bool {
+	return false
+}
+
+func (c *commandREIN) RequiresAuth() bool {
+	return false
+}
+
+func (c *commandREIN) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandREIN) Execute(conn *Connection, args string) error {
+	conn.reset()
+	conn.WriteMessage(220, "Service ready for new user")
+	return nil
+}
+
+// REST sets the offset the next RETR or STOR starts at
+type commandREST struct{}
+
+func (c *commandREST) RequiresParams() bool {
+	return true
+}
+
+func (c *commandREST) RequiresAuth() bool {
+	return true
+}
+
+func (c *commandREST) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandREST) Execute(conn *Connection, args string) error {
+	offset, err := strconv.ParseInt(args, 10, 64)
+	if err != nil || offset < 0 {
+		conn.WriteMessage(501, "Invalid restart offset")
+		return nil
+	}
+
+	conn.RestartOffset = offset
+	conn.WriteMessage(350, "Restarting at "+args+", send STOR or RETR to initiate transfer")
+	return nil
+}
+
 // RETR downloads a file
 type commandRETR struct{}
 
@@ -476,21 +978,64 @@ func (c *commandRETR) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandRETR) Permission() Permission {
+	return PermRead
+}
+
 func (c *commandRETR) Execute(conn *Connection, args string) error {
+	offset := conn.takeRestartOffset()
+
+	if !conn.checkDataConnection() {
+		return nil
+	}
+
 	path := conn.BuildPath(args)
 
-	file, err := conn.Filesystem.ReadFile(path)
+	file, err := statFile(conn.Filesystem, path)
+	if err != nil {
+		conn.WriteMessage(551, "File not available")
+		return nil
+	}
+
+	if offset > file.Size {
+		conn.WriteMessage(554, "Invalid REST parameter")
+		return nil
+	}
+
+	reader, err := conn.Filesystem.Open(path)
 	if err != nil {
 		conn.WriteMessage(551, "File not available")
 		return nil
 	}
+	defer reader.Close()
+
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		conn.WriteMessage(554, "Invalid REST parameter")
+		return nil
+	}
+
+	// Converting line endings changes the size, it is only known up front
+	// for binary transfers
+	if conn.TransferType == TypeASCII {
+		conn.WriteMessage(150, "Data transfer starting")
+	} else {
+		conn.WriteMessage(150, "Data transfer starting "+strconv.FormatInt(file.Size-offset, 10)+" bytes")
+	}
 
-	conn.WriteMessage(150, "Data transfer starting "+strconv.Itoa(file.Size)+" bytes")
+	writer := conn.dataWriter()
 
-	conn.DataSocket.Write(file.Content)
-	conn.DataSocket.Close()
+	sent, err := io.Copy(conn.downloadWriter(writer), reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	conn.closeDataSocket()
 
-	conn.WriteMessage(226, "Closing data connection, sent "+strconv.Itoa(file.Size)+" bytes")
+	if err != nil {
+		conn.writeTransferError(err)
+		return nil
+	}
+
+	conn.WriteMessage(226, "Closing data connection, sent "+strconv.FormatInt(sent, 10)+" bytes")
 	return nil
 }
 
@@ -505,6 +1050,10 @@ func (c *commandRNFR) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandRNFR) Permission() Permission {
+	return PermRename
+}
+
 func (c *commandRNFR) Execute(conn *Connection, args string) error {
 	conn.RenameFrom = conn.BuildPath(args)
 
@@ -523,10 +1072,23 @@ func (c *commandRNTO) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandRNTO) Permission() Permission {
+	return PermRename
+}
+
 func (c *commandRNTO) Execute(conn *Connection, args string) error {
+	if conn.RenameFrom == "" {
+		conn.WriteMessage(503, "Bad sequence of commands, send RNFR first")
+		return nil
+	}
+
+	// The source only applies to the RNTO right after RNFR
+	from := conn.RenameFrom
+	conn.RenameFrom = ""
+
 	path := conn.BuildPath(args)
 
-	if err := conn.Filesystem.Rename(conn.RenameFrom, path); err == nil {
+	if err := conn.Filesystem.Rename(from, path); err == nil {
 		conn.WriteMessage(250, "File renamed")
 	} else {
 		conn.WriteMessage(550, "Action not taken")
@@ -546,6 +1108,10 @@ func (c *commandRMD) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandRMD) Permission() Permission {
+	return PermDelete
+}
+
 func (c *commandRMD) Execute(conn *Connection, args string) error {
 	path := conn.BuildPath(args)
 
@@ -558,6 +1124,72 @@ func (c *commandRMD) Execute(conn *Connection, args string) error {
 	return nil
 }
 
+// SITE runs server specific commands, only CHMOD is supported
+type commandSITE struct{}
+
+func (c *commandSITE) RequiresParams() bool {
+	return true
+}
+
+func (c *commandSITE) RequiresAuth() bool {
+	return true
+}
+
+// Checked by the subcommands, the arguments are not a path
+func (c *commandSITE) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandSITE) Execute(conn *Connection, args string) error {
+	parts := strings.SplitN(args, " ", 2)
+
+	switch strings.ToUpper(parts[0]) {
+	case "CHMOD":
+		if len(parts) < 2 {
+			conn.WriteMessage(501, "Usage: SITE CHMOD <mode> <path>")
+			return nil
+		}
+
+		return c.chmod(conn, parts[1])
+	}
+
+	conn.WriteMessage(502, "Unknown SITE command")
+	return nil
+}
+
+func (c *commandSITE) chmod(conn *Connection, args string) error {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(parts) != 2 {
+		conn.WriteMessage(501, "Usage: SITE CHMOD <mode> <path>")
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil || mode > 0777 {
+		conn.WriteMessage(501, "Invalid mode")
+		return nil
+	}
+
+	chmoder, ok := conn.Filesystem.(Chmoder)
+	if !ok {
+		conn.WriteMessage(502, "SITE CHMOD not supported")
+		return nil
+	}
+
+	if !conn.Allows(PermWrite, conn.VirtualPath(parts[1])) {
+		conn.WriteMessage(550, "Permission denied")
+		return nil
+	}
+
+	if err := chmoder.Chmod(conn.BuildPath(parts[1]), os.FileMode(mode)); err != nil {
+		conn.WriteMessage(550, "Action not taken")
+		return nil
+	}
+
+	conn.WriteMessage(200, "SITE CHMOD command successful")
+	return nil
+}
+
 // SIZE returns bytes count of a file
 type commandSIZE struct{}
 
@@ -569,16 +1201,39 @@ func (c *commandSIZE) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandSIZE) Permission() Permission {
+	return PermList
+}
+
 func (c *commandSIZE) Execute(conn *Connection, args string) error {
 	path := conn.BuildPath(args)
 
-	bytes, err := conn.Filesystem.Size(path)
+	file, err := statFile(conn.Filesystem, path)
+	if err != nil {
+		conn.WriteMessage(450, "file not available")
+		return nil
+	}
+
+	if conn.TransferType != TypeASCII {
+		conn.WriteMessage(213, strconv.FormatInt(file.Size, 10))
+		return nil
+	}
+
+	// RFC 3659 wants the number of bytes a RETR would send in this TYPE
+	reader, err := conn.Filesystem.Open(path)
 	if err != nil {
 		conn.WriteMessage(450, "file not available")
 		return nil
 	}
+	defer reader.Close()
 
-	conn.WriteMessage(213, strconv.Itoa(bytes))
+	size, err := asciiSize(reader)
+	if err != nil {
+		conn.WriteMessage(450, "file not available")
+		return nil
+	}
+
+	conn.WriteMessage(213, strconv.FormatInt(size, 10))
 	return nil
 }
 
@@ -593,27 +1248,125 @@ func (c *commandSTOR) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandSTOR) Permission() Permission {
+	return PermWrite
+}
+
 func (c *commandSTOR) Execute(conn *Connection, args string) error {
+	offset := conn.takeRestartOffset()
+
+	if !conn.checkDataConnection() {
+		return nil
+	}
+
 	path := conn.BuildPath(args)
 
-	conn.WriteMessage(150, "Data transfer starting")
+	writer, err := conn.Filesystem.CreateAt(path, offset)
+	if err == ErrInvalidOffset {
+		conn.WriteMessage(554, "Invalid REST parameter")
+		return nil
+	} else if err != nil {
+		conn.WriteMessage(550, "Action not taken")
+		return nil
+	}
 
-	data, err := ioutil.ReadAll(conn.DataSocket)
-	if err != nil {
-		conn.WriteMessage(450, "Error during transfer")
+	receiveData(conn, writer, "")
+	return nil
+}
+
+// STOU stores a file under a name that is not taken yet
+type commandSTOU struct{}
+
+func (c *commandSTOU) RequiresParams() bool {
+	return false
+}
+
+func (c *commandSTOU) RequiresAuth() bool {
+	return true
+}
+
+// The file is written in the working directory whatever the argument says,
+// the permission is checked against the name chosen in Execute
+func (c *commandSTOU) Permission() Permission {
+	return PermNone
+}
+
+func (c *commandSTOU) Execute(conn *Connection, args string) error {
+	conn.takeRestartOffset()
+
+	// The argument, if any, is a suggestion the name is derived from
+	base := filepath.Base("/" + args)
+	if base == "/" {
+		base = "file"
+	}
+
+	name := base
+	for i := 1; ; i++ {
+		if _, err := conn.Filesystem.Stat(conn.BuildPath(name)); err != nil {
+			break
+		}
+
+		name = base + "." + strconv.Itoa(i)
+	}
+
+	if !conn.Allows(PermWrite, conn.VirtualPath(name)) {
+		conn.WriteMessage(550, "Permission denied")
 		return nil
 	}
 
-	err = conn.Filesystem.WriteFile(path, data)
+	if !conn.checkDataConnection() {
+		return nil
+	}
+
+	writer, err := conn.Filesystem.Create(conn.BuildPath(name))
 	if err != nil {
 		conn.WriteMessage(550, "Action not taken")
 		return nil
 	}
 
-	conn.WriteMessage(226, "OK, received "+strconv.Itoa(len(data))+" bytes")
+	receiveData(conn, writer, name)
 	return nil
 }
 
+// Copies an upload from the data socket into the writer, shared by the
+// commands storing files. A unique name chosen by STOU is reported to the
+// client.
+func receiveData(conn *Connection, writer io.WriteCloser, unique string) {
+	if unique != "" {
+		conn.WriteMessage(150, "FILE: "+unique)
+	} else {
+		conn.WriteMessage(150, "Data transfer starting")
+	}
+
+	upload := conn.uploadWriter(writer)
+
+	var received int64
+	reader, err := conn.dataReader()
+	if err == nil {
+		received, err = io.Copy(upload, reader)
+		reader.Close()
+	}
+	conn.closeDataSocket()
+
+	if err != nil {
+		abortWriter(writer)
+		conn.writeTransferError(err)
+		return
+	}
+
+	if err := upload.Close(); err != nil {
+		conn.WriteMessage(550, "Action not taken")
+		return
+	}
+
+	message := "OK, received " + strconv.FormatInt(received, 10) + " bytes"
+	if unique != "" {
+		message += " (unique file name: " + unique + ")"
+	}
+
+	conn.WriteMessage(226, message)
+}
+
 // STRU is an obsolete command, only one parameter is used nowadays.
 type commandSTRU struct{}
 
@@ -625,6 +1378,10 @@ func (c *commandSTRU) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandSTRU) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandSTRU) Execute(conn *Connection, args string) error {
 	if strings.ToUpper(args) == "F" {
 		conn.WriteMessage(200, "OK")
@@ -646,12 +1403,16 @@ func (c *commandSYST) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandSYST) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandSYST) Execute(conn *Connection, args string) error {
 	conn.WriteMessage(215, "UNIX Type: L8")
 	return nil
 }
 
-// We only care about binary more though.
+// TYPE switches between ASCII, which converts line endings, and binary
 type commandTYPE struct{}
 
 func (c *commandTYPE) RequiresParams() bool {
@@ -662,19 +1423,28 @@ func (c *commandTYPE) RequiresAuth() bool {
 	return true
 }
 
+func (c *commandTYPE) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandTYPE) Execute(conn *Connection, args string) error {
-	if strings.ToUpper(args) == "A" {
+	switch strings.Join(strings.Fields(strings.ToUpper(args)), " ") {
+	case "A", "A N":
+		conn.TransferType = TypeASCII
 		conn.WriteMessage(200, "Type set to ASCII")
-	} else if strings.ToUpper(args) == "I" {
+	case "I", "L 8":
+		conn.TransferType = TypeBinary
 		conn.WriteMessage(200, "Type set to binary")
-	} else {
-		conn.WriteMessage(500, "Invalid type")
+	case "A T", "A C", "E", "E N", "E T", "E C":
+		conn.WriteMessage(504, "Type not supported")
+	default:
+		conn.WriteMessage(501, "Invalid type")
 	}
 
 	return nil
 }
 
-// First part of the authentication
+// First part of the authentication, starts a new login
 type commandUSER struct{}
 
 func (c *commandUSER) RequiresParams() bool {
@@ -685,7 +1455,18 @@ func (c *commandUSER) RequiresAuth() bool {
 	return false
 }
 
+func (c *commandUSER) Permission() Permission {
+	return PermNone
+}
+
 func (c *commandUSER) Execute(conn *Connection, args string) error {
+	if conn.Server.RequireTLS && !conn.Secure {
+		conn.WriteMessage(534, "Policy requires TLS, use AUTH TLS first")
+		return nil
+	}
+
+	conn.reset()
+	conn.User = args
 	conn.WriteMessage(331, "User name ok, password required")
 	return nil
 }
@@ -0,0 +1,261 @@
+package ftptest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreAndRetrieve(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.upload("STOR file", []byte("hello world"))
+	if got := client.download("RETR file"); string(got) != "hello world" {
+		t.Fatalf("RETR %q", got)
+	}
+
+	client.cmd(213, "SIZE file")
+	client.cmd(229, "EPSV")
+	client.cmd(550, "STOR missing/file")
+	client.cmd(551, "RETR missing")
+}
+
+func TestRename(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.MkDir("/incoming")
+	server.Filesystem.WriteFile("/incoming/file", []byte("data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(503, "RNTO /incoming/z")
+
+	client.cmd(350, "RNFR /incoming")
+	client.cmd(250, "RNTO /moved")
+
+	// RNFR is used up by the RNTO
+	client.cmd(503, "RNTO /again")
+
+	if got := readFile(t, server.Filesystem, "/moved/file"); got != "data" {
+		t.Fatalf("moved file %q", got)
+	}
+
+	client.cmd(350, "RNFR /moved")
+	client.cmd(550, "RNTO /moved/inside")
+	client.cmd(350, "RNFR /")
+	client.cmd(550, "RNTO /moved/root")
+}
+
+func TestDirectories(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(257, "MKD foo")
+	client.cmd(257, "MKD foobar")
+	client.cmd(257, "MKD foo/bar")
+	client.cmd(550, "MKD foo")
+
+	client.cmd(250, "CWD foo/bar")
+	if message := client.cmd(257, "PWD"); !strings.Contains(message, `"/foo/bar"`) {
+		t.Fatalf("PWD %q", message)
+	}
+
+	client.cmd(250, "CDUP")
+	client.cmd(250, "RMD /foo")
+	client.cmd(550, "CWD /foo")
+	client.cmd(250, "CWD /foobar")
+	client.cmd(550, "RMD /")
+}
+
+func TestDelete(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(250, "DELE file")
+	client.cmd(550, "DELE file")
+}
+
+func TestListingMissingDirectory(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	for _, command := range []string{"LIST /missing", "NLST /missing"} {
+		socket := client.passive()
+		client.cmd(550, "%s", command)
+		socket.Close()
+	}
+
+	if got := string(client.download("LIST -la")); !strings.Contains(got, " file\r\n") {
+		t.Fatalf("LIST -la returned %q", got)
+	}
+}
+
+func TestModificationTime(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.MkDir("/dir")
+
+	client := dialServer(t, server)
+	client.login()
+
+	message := client.cmd(213, "MDTM dir")
+
+	modified, err := time.Parse("20060102150405", message)
+	if err != nil {
+		t.Fatalf("MDTM %q: %v", message, err)
+	}
+
+	if time.Since(modified) > time.Minute {
+		t.Fatalf("MDTM %s is not the creation time", modified)
+	}
+
+	client.cmd(450, "MDTM missing")
+}
+
+func TestListing(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.MkDir("/dir")
+	server.Filesystem.WriteFile("/file", []byte("data"))
+	server.Filesystem.Chown("/file", "alice", "staff")
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(200, "SITE CHMOD 600 file")
+
+	lines := strings.Split(strings.TrimSpace(string(client.download("LIST"))), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("LIST returned %q", lines)
+	}
+
+	if !strings.HasPrefix(lines[0], "drwxr-xr-x 1 owner group") || !strings.HasSuffix(lines[0], " dir") {
+		t.Errorf("directory listed as %q", lines[0])
+	}
+
+	if !strings.HasPrefix(lines[1], "-rw------- 1 alice staff") || !strings.HasSuffix(lines[1], " file") {
+		t.Errorf("file listed as %q", lines[1])
+	}
+
+	if got := strings.TrimSpace(string(client.download("NLST"))); got != "dir\r\nfile" {
+		t.Errorf("NLST returned %q", got)
+	}
+
+	client.cmd(501, "SITE CHMOD 999 file")
+	client.cmd(550, "SITE CHMOD 600 missing")
+}
+
+func TestFailedUploadKeepsFile(t *testing.T) {
+	server := NewServer(t, WithPassiveTimeout(100*time.Millisecond))
+	server.Filesystem.WriteFile("/file", []byte("precious"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	for _, command := range []string{"STOR file", "APPE file"} {
+		client.cmd(229, "EPSV")
+		client.cmd(150, "%s", command)
+		client.expect(425)
+	}
+
+	if got := readFile(t, server.Filesystem, "/file"); got != "precious" {
+		t.Fatalf("file changed to %q", got)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("hello world"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(350, "REST 6")
+	if got := client.download("RETR file"); string(got) != "world" {
+		t.Fatalf("RETR after REST %q", got)
+	}
+
+	// The offset only applies to the next transfer
+	if got := client.download("RETR file"); string(got) != "hello world" {
+		t.Fatalf("RETR without REST %q", got)
+	}
+
+	client.cmd(350, "REST 5")
+	client.upload("STOR file", []byte(", bye"))
+	if got := readFile(t, server.Filesystem, "/file"); got != "hello, bye" {
+		t.Fatalf("STOR after REST stored %q", got)
+	}
+
+	client.cmd(501, "REST -1")
+	client.cmd(350, "REST 100")
+	client.cmd(229, "EPSV")
+	client.cmd(554, "RETR file")
+}
+
+func TestAppend(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.upload("APPE log", []byte("first\n"))
+	client.upload("APPE log", []byte("second\n"))
+
+	if got := readFile(t, server.Filesystem, "/log"); got != "first\nsecond\n" {
+		t.Fatalf("APPE stored %q", got)
+	}
+}
+
+func TestStoreUnique(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/report", []byte("existing"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	message := client.upload("STOU report", []byte("new"))
+	if message != "FILE: report.1" {
+		t.Fatalf("STOU reply %q", message)
+	}
+
+	if got := readFile(t, server.Filesystem, "/report"); got != "existing" {
+		t.Fatalf("STOU overwrote the file with %q", got)
+	}
+
+	if got := readFile(t, server.Filesystem, "/report.1"); got != "new" {
+		t.Fatalf("STOU stored %q", got)
+	}
+}
+
+func TestStoreUniquePermissions(t *testing.T) {
+	server := NewServer(t,
+		WithPermissions("test", PermRead|PermList),
+		WithPathPermissions("test", "/incoming", PermAll),
+	)
+	server.Filesystem.MkDir("/incoming")
+
+	client := dialServer(t, server)
+	client.login()
+
+	// The name is taken from the argument, but the file goes into the CWD
+	client.cmd(550, "STOU /incoming/evil")
+	if _, err := server.Filesystem.Stat("/evil"); err == nil {
+		t.Fatal("STOU wrote outside the writable directory")
+	}
+
+	client.cmd(250, "CWD /incoming")
+	client.upload("STOU file", []byte("data"))
+
+	if got := readFile(t, server.Filesystem, "/incoming/file"); got != "data" {
+		t.Fatalf("STOU stored %q", got)
+	}
+}
@@ -2,22 +2,47 @@ package ftptest
 
 import (
 	"bufio"
+	"compress/zlib"
+	"crypto/tls"
+	"io"
 	"net"
 	filepath "path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Connection struct {
+	Server           *FTPServer
 	Connection       net.Conn
 	DataSocket       DataSocket
 	Buffer           *bufio.Reader
-	Filesystem       *Filesystem
+	Filesystem       Backend
 	Authenticated    bool
+	User             string
+	Identity         *Identity
+	Root             string
 	WorkingDirectory string
 
+	Secure        bool
+	BufferSizeSet bool
+	ProtectedData bool
+
+	MLSTFacts     []string
+	RestartOffset int64
+	TransferType  string
+
+	// Set with MODE and OPTS MODE Z
+	TransferMode     string
+	CompressionLevel int
+
 	RenameFrom string
 	RenameTo   string
+
+	mutex  sync.Mutex
+	active bool
+	closed bool
 }
 
 func (c *Connection) WriteMessage(code int, message string) {
@@ -26,17 +51,84 @@ func (c *Connection) WriteMessage(code int, message string) {
 	c.Connection.Write([]byte(sCode + " " + message + "\r\n"))
 }
 
+// Marks the connection as logged in as the given user and moves it into
+// the user's home directory
+func (c *Connection) login(identity Identity) error {
+	root := c.Server.homeDirectory(identity)
+	if err := dirExists(c.Filesystem, root); err != nil {
+		return err
+	}
+
+	c.Authenticated = true
+	c.Identity = &identity
+	c.Root = root
+	c.WorkingDirectory = "/"
+	return nil
+}
+
+// Checks whether the logged in user has the permissions for a virtual path
+func (c *Connection) Allows(permission Permission, path string) bool {
+	if permission == PermNone {
+		return true
+	}
+
+	if c.Identity == nil {
+		return false
+	}
+
+	return c.Server.permissions(*c.Identity).Allows(permission, path)
+}
+
+// Drops the login, any pending command state and puts the transfer
+// parameters back to their defaults
+func (c *Connection) reset() {
+	c.Authenticated = false
+	c.User = ""
+	c.Identity = nil
+	c.Root = "/"
+	c.WorkingDirectory = "/"
+	c.RenameFrom = ""
+	c.RenameTo = ""
+	c.RestartOffset = 0
+	c.MLSTFacts = nil
+	c.TransferType = TypeBinary
+	c.TransferMode = ModeStream
+	c.CompressionLevel = zlib.DefaultCompression
+	c.closeDataSocket()
+}
+
+// Writes a multi-line reply whose entries are indented by a space, as used
+// by FEAT and MLST
+func (c *Connection) WriteListMessage(code int, header string, entries []string, footer string) {
+	sCode := strconv.Itoa(code)
+
+	c.Connection.Write([]byte(sCode + "-" + header + "\r\n"))
+	for _, entry := range entries {
+		c.Connection.Write([]byte(" " + entry + "\r\n"))
+	}
+
+	c.WriteMessage(code, footer)
+}
+
+// Writes a multi-line reply, the last line closes it
+func (c *Connection) WriteMultilineMessage(code int, lines []string) {
+	if len(lines) == 0 {
+		c.WriteMessage(code, "")
+		return
+	}
+
+	sCode := strconv.Itoa(code)
+	for _, line := range lines[:len(lines)-1] {
+		c.Connection.Write([]byte(sCode + "-" + line + "\r\n"))
+	}
+
+	c.WriteMessage(code, lines[len(lines)-1])
+}
+
 func (c *Connection) ChangeWorkingDirectory(path string) error {
-	new_directory := filepath.Clean(
-		strings.Replace(
-			filepath.Join(c.WorkingDirectory, path),
-			"..",
-			"",
-			-1,
-		),
-	)
-
-	if err := c.Filesystem.DirExists(new_directory); err != nil {
+	new_directory := c.VirtualPath(path)
+
+	if err := dirExists(c.Filesystem, c.RealPath(new_directory)); err != nil {
 		return err
 	}
 
@@ -44,21 +136,183 @@ func (c *Connection) ChangeWorkingDirectory(path string) error {
 	return nil
 }
 
+// Path as seen by the client, relative to the root it is jailed into
+func (c *Connection) VirtualPath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = filepath.Join(c.WorkingDirectory, path)
+	}
+
+	// Cleaning a rooted path drops any ".." that would escape the root
+	return filepath.Clean("/" + path)
+}
+
+// Maps a virtual path to its location in the filesystem
+func (c *Connection) RealPath(virtual string) string {
+	return filepath.Join(c.Root, virtual)
+}
+
+// Location in the filesystem of a path sent by the client
 func (c *Connection) BuildPath(path string) string {
-	path = filepath.Join(c.WorkingDirectory, path)
+	return c.RealPath(c.VirtualPath(path))
+}
+
+// Switches the control connection to TLS, the handshake happens on the next read
+func (c *Connection) upgradeToTLS(config *tls.Config) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Connection = tls.Server(c.Connection, config)
+	c.Buffer = bufio.NewReader(c.Connection)
+	c.Secure = true
+}
+
+// TLS config for new data sockets, nil unless PROT P is in effect
+func (c *Connection) dataTLSConfig() *tls.Config {
+	if !c.ProtectedData {
+		return nil
+	}
+
+	return c.Server.TLSConfig
+}
+
+// Refuses the transfer when policy requires PROT P and it was not sent, or
+// when no data socket was opened
+func (c *Connection) checkDataConnection() bool {
+	if c.Server.RequireProtectedData && !c.ProtectedData {
+		c.WriteMessage(521, "Data connections must be protected, use PROT P")
+		return false
+	}
+
+	if c.DataSocket == nil {
+		c.WriteMessage(425, "Use PORT or PASV first")
+		return false
+	}
+
+	return true
+}
+
+// Whether the client reached the server over IPv6
+func (c *Connection) isIPv6() bool {
+	host, _, _ := net.SplitHostPort(c.Connection.LocalAddr().String())
+	return net.ParseIP(host).To4() == nil
+}
+
+// Settings for the next passive data socket
+func (c *Connection) passiveConfig() PassiveConfig {
+	// Without explicit settings, listen on the interface the client reached
+	localHost, _, _ := net.SplitHostPort(c.Connection.LocalAddr().String())
+
+	bindHost := c.Server.PassiveBindHost
+	if bindHost == "" {
+		bindHost = localHost
+	}
 
-	if path[0] != '/' {
-		path = "/" + path
+	publicHost := c.Server.PassivePublicHost
+	if publicHost == "" && net.ParseIP(bindHost).IsUnspecified() {
+		publicHost = localHost
 	}
 
-	return filepath.Clean(path)
+	return PassiveConfig{
+		AcceptTimeout: c.Server.PassiveTimeout,
+		Timeout:       c.Server.DataTimeout,
+		TLSConfig:     c.dataTLSConfig(),
+		BindHost:      bindHost,
+		PublicHost:    publicHost,
+		PortMin:       c.Server.PassivePortMin,
+		PortMax:       c.Server.PassivePortMax,
+	}
+}
+
+// Replaces the data socket, closing the previous one
+func (c *Connection) SetDataSocket(socket DataSocket) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.DataSocket != nil {
+		c.DataSocket.Close()
+	}
+
+	c.DataSocket = socket
+}
+
+// Returns the offset set by REST and clears it, it only applies to the
+// transfer right after it
+func (c *Connection) takeRestartOffset() int64 {
+	offset := c.RestartOffset
+	c.RestartOffset = 0
+	return offset
+}
+
+// Writer sending data to the client, compressed in MODE Z. Closing it ends
+// the compressed stream, the socket stays open.
+func (c *Connection) dataWriter() io.WriteCloser {
+	if c.TransferMode == ModeDeflate {
+		writer, err := zlib.NewWriterLevel(c.DataSocket, c.CompressionLevel)
+		if err == nil {
+			return writer
+		}
+	}
+
+	return nopWriteCloser{c.DataSocket}
+}
+
+// Reader receiving data from the client, decompressed in MODE Z
+func (c *Connection) dataReader() (io.ReadCloser, error) {
+	if c.TransferMode == ModeDeflate {
+		return zlib.NewReader(c.DataSocket)
+	}
+
+	return io.NopCloser(c.DataSocket), nil
+}
+
+// Wraps the writer of a download, converting line endings in ASCII mode
+func (c *Connection) downloadWriter(writer io.Writer) io.Writer {
+	if c.TransferType == TypeASCII {
+		return &crlfWriter{writer: writer}
+	}
+
+	return writer
+}
+
+// Wraps the writer storing an upload, converting line endings in ASCII mode
+func (c *Connection) uploadWriter(writer io.WriteCloser) io.WriteCloser {
+	if c.TransferType == TypeASCII {
+		return &lfWriter{WriteCloser: writer}
+	}
+
+	return writer
+}
+
+// Closes the data socket after a transfer, each socket is used only once
+func (c *Connection) closeDataSocket() {
+	c.SetDataSocket(nil)
+}
+
+// Replies to a failed transfer, 425 when the client never connected to the
+// data socket
+func (c *Connection) writeTransferError(err error) {
+	if err == ErrDataSocketUnavailable {
+		c.WriteMessage(425, "Can't open data connection")
+		return
+	}
+
+	c.WriteMessage(426, "Transfer aborted")
 }
 
 func (c *Connection) SendDataThroughSocket(data string) {
 	bytes := len(data)
 
-	c.DataSocket.Write([]byte(data))
-	c.DataSocket.Close()
+	writer := c.dataWriter()
+	_, err := writer.Write([]byte(data))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	c.closeDataSocket()
+
+	if err != nil {
+		c.writeTransferError(err)
+		return
+	}
 
 	message := "Closing data connection, sent " + strconv.Itoa(bytes) + " bytes"
 	c.WriteMessage(226, message)
@@ -84,43 +338,115 @@ func (c *Connection) ParseIncoming() (string, string, error) {
 }
 
 func (c *Connection) Serve() {
+	defer c.Close()
+
 	// Send a welcome message
-	c.WriteMessage(220, "Welcome to a Go FTPTest server!")
+	c.WriteMultilineMessage(220, c.Server.Welcome)
 
 	// Read commands
 	for {
+		if c.Server.IdleTimeout > 0 {
+			c.Connection.SetReadDeadline(time.Now().Add(c.Server.IdleTimeout))
+		}
+
 		// Parse the incoming command
 		cmd, args, err := c.ParseIncoming()
 		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				c.WriteMessage(421, "Idle timeout, closing control connection")
+			}
 			return
 		}
 
-		// Find the command
-		command, ok := commands[cmd]
-		if !ok {
-			c.WriteMessage(500, "Command not found")
-			continue
-		}
-
-		// Perform basic ACL checks
-		if command.RequiresAuth() && !c.Authenticated {
-			c.WriteMessage(530, "Not logged in")
-			continue
+		// Connection might have been closed while waiting for a command
+		if !c.setActive(true) {
+			return
 		}
 
-		// Check if command is valid
-		if command.RequiresParams() && args == "" {
-			c.WriteMessage(553, "This command requires params")
-			continue
-		}
+		err = c.execute(cmd, args)
+		c.setActive(false)
 
-		// Execute the command
-		err = command.Execute(c, args)
 		if err == ErrQuitRequest {
-			c.Connection.Close()
-			break
-		} else if err != nil {
-			c.WriteMessage(550, err.Error())
+			return
 		}
 	}
 }
+
+// Closes the control connection and the data socket
+func (c *Connection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closeLocked()
+}
+
+// Closes the sockets, the caller holds the mutex
+func (c *Connection) closeLocked() error {
+	c.closed = true
+
+	if c.DataSocket != nil {
+		c.DataSocket.Close()
+	}
+
+	return c.Connection.Close()
+}
+
+func (c *Connection) execute(cmd string, args string) error {
+	// Find the command
+	command, ok := commands[cmd]
+	if !ok || !c.Server.commandEnabled(cmd) {
+		c.WriteMessage(500, "Command not found")
+		return nil
+	}
+
+	// Perform basic ACL checks
+	if command.RequiresAuth() && !c.Authenticated {
+		c.WriteMessage(530, "Not logged in")
+		return nil
+	}
+
+	// Check if command is valid
+	if command.RequiresParams() && args == "" {
+		c.WriteMessage(553, "This command requires params")
+		return nil
+	}
+
+	// Check the user is allowed to touch the path
+	if !c.Allows(command.Permission(), c.VirtualPath(args)) {
+		c.WriteMessage(550, "Permission denied")
+		return nil
+	}
+
+	// Execute the command
+	err := command.Execute(c, args)
+	if err != nil && err != ErrQuitRequest {
+		c.WriteMessage(550, err.Error())
+	}
+
+	return err
+}
+
+// Marks the connection as executing a command. Returns false if the
+// connection has already been closed.
+func (c *Connection) setActive(active bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	c.active = active
+	return true
+}
+
+// Closes the connection unless it is in the middle of a command. Checking
+// and closing under one lock keeps a command from starting in between.
+func (c *Connection) closeIfIdle() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.active && !c.closed {
+		c.closeLocked()
+	}
+}
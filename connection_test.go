@@ -0,0 +1,32 @@
+package ftptest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReinitialize(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("a\nb\n"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(200, "TYPE A")
+	client.cmd(200, "MODE Z")
+	client.cmd(200, "OPTS MLST type;")
+	client.cmd(229, "EPSV")
+	client.cmd(220, "REIN")
+	client.cmd(530, "PWD")
+	client.login()
+
+	// The data socket is gone and transfers are binary and uncompressed again
+	client.cmd(425, "RETR file")
+	if got := client.download("RETR file"); string(got) != "a\nb\n" {
+		t.Fatalf("RETR after REIN %q", got)
+	}
+
+	if message := client.cmd(250, "MLST file"); !strings.Contains(message, "size=4;") {
+		t.Fatalf("MLST facts kept after REIN: %q", message)
+	}
+}
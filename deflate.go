@@ -0,0 +1,52 @@
+package ftptest
+
+import (
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Transfer modes set with MODE
+const (
+	ModeStream  = "S"
+	ModeDeflate = "Z"
+)
+
+// OPTS MODE Z sets the compression level of MODE Z, e.g. "Z LEVEL 9"
+func optsMODE(conn *Connection, args string) error {
+	fields := strings.Fields(strings.ToUpper(args))
+	if len(fields) == 0 || fields[0] != ModeDeflate || len(fields)%2 == 0 {
+		conn.WriteMessage(501, "Invalid MODE options")
+		return nil
+	}
+
+	level := conn.CompressionLevel
+	for i := 1; i < len(fields); i += 2 {
+		if fields[i] != "LEVEL" {
+			conn.WriteMessage(501, "Unknown MODE Z option "+fields[i])
+			return nil
+		}
+
+		value, err := strconv.Atoi(fields[i+1])
+		if err != nil || value < zlib.NoCompression || value > zlib.BestCompression {
+			conn.WriteMessage(501, "Invalid compression level")
+			return nil
+		}
+
+		level = value
+	}
+
+	conn.CompressionLevel = level
+	conn.WriteMessage(200, "MODE Z LEVEL set to "+strconv.Itoa(level))
+	return nil
+}
+
+// Closing does nothing, the data socket is closed separately
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,109 @@
+package ftptest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+)
+
+func inflate(t testing.TB, data []byte) string {
+	t.Helper()
+
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("zlib: %v", err)
+	}
+
+	plain, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("zlib: %v", err)
+	}
+
+	return string(plain)
+}
+
+func deflate(data string) []byte {
+	var buffer bytes.Buffer
+
+	writer := zlib.NewWriter(&buffer)
+	writer.Write([]byte(data))
+	writer.Close()
+
+	return buffer.Bytes()
+}
+
+func TestModeZ(t *testing.T) {
+	content := strings.Repeat("id,name,value\n", 1000)
+
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/export.csv", []byte(content))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(200, "MODE Z")
+	client.cmd(200, "OPTS MODE Z LEVEL 9")
+
+	compressed := client.download("RETR export.csv")
+	if len(compressed) >= len(content) {
+		t.Fatalf("RETR sent %d bytes for %d bytes of content", len(compressed), len(content))
+	}
+
+	if got := inflate(t, compressed); got != content {
+		t.Fatalf("RETR inflated to %d bytes", len(got))
+	}
+
+	client.upload("STOR upload", deflate("uploaded"))
+	if got := readFile(t, server.Filesystem, "/upload"); got != "uploaded" {
+		t.Fatalf("STOR stored %q", got)
+	}
+
+	if got := inflate(t, client.download("LIST")); !strings.Contains(got, " upload\r\n") {
+		t.Fatalf("LIST %q", got)
+	}
+
+	if got := inflate(t, client.download("MLSD")); !strings.Contains(got, " export.csv\r\n") {
+		t.Fatalf("MLSD %q", got)
+	}
+
+	client.cmd(200, "MODE S")
+	if got := client.download("RETR upload"); string(got) != "uploaded" {
+		t.Fatalf("RETR in MODE S %q", got)
+	}
+}
+
+func TestModeZOptions(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(504, "MODE B")
+	client.cmd(200, "OPTS MODE Z LEVEL 0")
+	client.cmd(501, "OPTS MODE Z LEVEL 10")
+	client.cmd(501, "OPTS MODE Z LEVEL")
+	client.cmd(501, "OPTS MODE Z ENGINE zlib")
+	client.cmd(501, "OPTS MODE S")
+}
+
+func TestModeZWithASCII(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("a\nb\n"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(200, "TYPE A")
+	client.cmd(200, "MODE Z")
+
+	if got := inflate(t, client.download("RETR file")); got != "a\r\nb\r\n" {
+		t.Fatalf("RETR %q", got)
+	}
+
+	client.upload("STOR upload", deflate("c\r\nd\r\n"))
+	if got := readFile(t, server.Filesystem, "/upload"); got != "c\nd\n" {
+		t.Fatalf("STOR stored %q", got)
+	}
+}
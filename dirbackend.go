@@ -0,0 +1,328 @@
+package ftptest
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirBackend serves a directory on disk, e.g. t.TempDir(), so fixtures can
+// be prepared and uploads inspected with the standard library
+type DirBackend struct {
+	Root string
+}
+
+// Creates a backend rooted at an existing directory
+func NewDirBackend(root string) (*DirBackend, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, ErrNotFound
+	}
+
+	return &DirBackend{Root: root}, nil
+}
+
+// Location of a path on disk. Cleaning a rooted path keeps it inside Root,
+// symlinks are resolved to refuse the ones leading out of it.
+func (d *DirBackend) osPath(path string) (string, error) {
+	name := filepath.Join(d.Root, filepath.Clean(string(filepath.Separator)+filepath.FromSlash(path)))
+
+	root, err := filepath.EvalSymlinks(d.Root)
+	if err != nil {
+		return "", convertError(err)
+	}
+
+	resolved, err := resolvePath(name)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrPermissionDenied
+	}
+
+	return name, nil
+}
+
+// Resolves the symlinks of the deepest existing part of a path, the missing
+// rest is appended as is. Dangling symlinks are refused.
+func resolvePath(name string) (string, error) {
+	rest := ""
+
+	for {
+		resolved, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+
+		if _, err := os.Lstat(name); err == nil {
+			return "", ErrPermissionDenied
+		}
+
+		parent := filepath.Dir(name)
+		if parent == name {
+			return "", convertError(err)
+		}
+
+		rest = filepath.Join(filepath.Base(name), rest)
+		name = parent
+	}
+}
+
+// Whether the path is Root itself, which is never removed or renamed
+func (d *DirBackend) isRoot(path string) bool {
+	name, err := d.osPath(path)
+	if err != nil {
+		return false
+	}
+
+	root, err := filepath.EvalSymlinks(d.Root)
+	if err != nil {
+		return false
+	}
+
+	resolved, err := filepath.EvalSymlinks(name)
+	return err == nil && resolved == root
+}
+
+func (d *DirBackend) MkDir(path string) error {
+	name, err := d.osPath(path)
+	if err != nil {
+		return err
+	}
+
+	return convertError(os.Mkdir(name, 0755))
+}
+
+func (d *DirBackend) RmDir(path string) error {
+	if err := dirExists(d, path); err != nil {
+		return err
+	}
+
+	if d.isRoot(path) {
+		return ErrRootDirectory
+	}
+
+	name, err := d.osPath(path)
+	if err != nil {
+		return err
+	}
+
+	return convertError(os.RemoveAll(name))
+}
+
+func (d *DirBackend) Open(path string) (io.ReadSeekCloser, error) {
+	if _, err := statFile(d, path); err != nil {
+		return nil, err
+	}
+
+	name, err := d.osPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	return file, convertError(err)
+}
+
+func (d *DirBackend) Create(path string) (io.WriteCloser, error) {
+	if err := dirExists(d, filepath.ToSlash(filepath.Dir(path))); err != nil {
+		return nil, ErrNoParent
+	}
+
+	target, err := d.osPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".upload-*")
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, convertError(err)
+	}
+
+	return &dirWriter{File: file, path: target}, nil
+}
+
+func (d *DirBackend) CreateAt(path string, offset int64) (io.WriteCloser, error) {
+	if offset == 0 {
+		return d.Create(path)
+	}
+
+	existing, err := statFile(d, path)
+	if err != nil || offset > existing.Size {
+		return nil, ErrInvalidOffset
+	}
+
+	source, err := d.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	writer, err := d.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.CopyN(writer, source, offset); err != nil {
+		abortWriter(writer)
+		return nil, convertError(err)
+	}
+
+	return writer, nil
+}
+
+func (d *DirBackend) Stat(path string) (*File, error) {
+	name, err := d.osPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return fileFromInfo(info), nil
+}
+
+func (d *DirBackend) List(path string) ([]*File, error) {
+	name, err := d.osPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	response := make([]*File, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		response = append(response, fileFromInfo(info))
+	}
+
+	return response, nil
+}
+
+func (d *DirBackend) Rename(from string, to string) error {
+	if from == "" || d.isRoot(from) {
+		return ErrNotFound
+	}
+
+	if d.isRoot(to) {
+		return ErrAlreadyExists
+	}
+
+	source, err := d.osPath(from)
+	if err != nil {
+		return err
+	}
+
+	target, err := d.osPath(to)
+	if err != nil {
+		return err
+	}
+
+	return convertError(os.Rename(source, target))
+}
+
+func (d *DirBackend) Remove(path string) error {
+	if _, err := statFile(d, path); err != nil {
+		return err
+	}
+
+	name, err := d.osPath(path)
+	if err != nil {
+		return err
+	}
+
+	return convertError(os.Remove(name))
+}
+
+func (d *DirBackend) Chmod(path string, mode os.FileMode) error {
+	name, err := d.osPath(path)
+	if err != nil {
+		return err
+	}
+
+	return convertError(os.Chmod(name, mode&os.ModePerm))
+}
+
+// Writes an upload to a temporary file next to the target and renames it
+// into place when closed, the existing file is untouched until then
+type dirWriter struct {
+	*os.File
+	path string
+}
+
+func (w *dirWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return convertError(err)
+	}
+
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		os.Remove(w.Name())
+		return convertError(err)
+	}
+
+	return nil
+}
+
+func (w *dirWriter) Abort() error {
+	w.File.Close()
+	return convertError(os.Remove(w.Name()))
+}
+
+func fileFromInfo(info os.FileInfo) *File {
+	file := &File{
+		Name:         info.Name(),
+		Type:         "file",
+		TimeModified: info.ModTime(),
+		Size:         info.Size(),
+		Owner:        DefaultOwner,
+		Group:        DefaultGroup,
+		Mode:         info.Mode(),
+	}
+
+	if info.IsDir() {
+		file.Type = "directory"
+	}
+
+	return file
+}
+
+// Maps errors of the os package to the ones used by the in-memory
+// filesystem. They end up in replies, so paths on disk must not leak.
+func convertError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return ErrNotFound
+	case os.IsExist(err):
+		return ErrAlreadyExists
+	case os.IsPermission(err):
+		return ErrPermissionDenied
+	}
+
+	return ErrActionFailed
+}
@@ -0,0 +1,154 @@
+package ftptest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDirServer(t *testing.T, opts ...Option) (*FTPServer, string) {
+	t.Helper()
+
+	root := t.TempDir()
+
+	backend, err := NewDirBackend(root)
+	if err != nil {
+		t.Fatalf("NewDirBackend: %v", err)
+	}
+
+	return NewServer(t, append(opts, WithBackend(backend))...), root
+}
+
+func TestDirBackend(t *testing.T) {
+	server, root := newDirServer(t)
+	os.WriteFile(filepath.Join(root, "fixture"), []byte("from disk"), 0644)
+
+	client := dialServer(t, server)
+	client.login()
+
+	if got := client.download("RETR fixture"); string(got) != "from disk" {
+		t.Fatalf("RETR %q", got)
+	}
+
+	client.cmd(257, "MKD dir")
+	client.upload("STOR dir/upload", []byte("uploaded"))
+
+	data, err := os.ReadFile(filepath.Join(root, "dir", "upload"))
+	if err != nil || string(data) != "uploaded" {
+		t.Fatalf("upload on disk %q (%v)", data, err)
+	}
+
+	client.cmd(350, "REST 3")
+	client.upload("STOR dir/upload", []byte("LOAD"))
+	client.upload("APPE dir/upload", []byte("ED"))
+
+	data, _ = os.ReadFile(filepath.Join(root, "dir", "upload"))
+	if string(data) != "uplLOADED" {
+		t.Fatalf("upload on disk %q", data)
+	}
+
+	client.cmd(350, "RNFR dir/upload")
+	client.cmd(250, "RNTO moved")
+	client.cmd(250, "DELE moved")
+	client.cmd(250, "RMD dir")
+
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Fatalf("%d entries left on disk", len(entries))
+	}
+}
+
+func TestDirBackendRoot(t *testing.T) {
+	server, root := newDirServer(t)
+	os.WriteFile(filepath.Join(root, "file"), []byte("data"), 0644)
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(550, "RMD /")
+	client.cmd(550, "RMD ../..")
+	client.cmd(350, "RNFR /")
+	client.cmd(550, "RNTO /moved")
+
+	if _, err := os.Stat(filepath.Join(root, "file")); err != nil {
+		t.Fatalf("root changed: %v", err)
+	}
+
+	// Errors do not tell where the files are on disk
+	for _, command := range []string{"CWD /file/dir", "DELE /file/dir", "DELE /missing"} {
+		if message := client.cmd(550, "%s", command); strings.Contains(message, root) {
+			t.Errorf("%s replied %q", command, message)
+		}
+	}
+}
+
+func TestDirBackendSymlinks(t *testing.T) {
+	server, root := newDirServer(t)
+
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "host"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(root, "link"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	os.WriteFile(filepath.Join(root, "dir", "file"), []byte("inside"), 0644)
+	os.Symlink(filepath.Join(root, "dir"), filepath.Join(root, "inside"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	tests := map[string]int{
+		"RETR link/host":   551,
+		"STOR link/upload": 550,
+		"STOR dangling":    550,
+		"LIST link":        550,
+	}
+
+	for command, code := range tests {
+		socket := client.passive()
+		client.cmd(code, "%s", command)
+		socket.Close()
+	}
+
+	client.cmd(550, "CWD link")
+	client.cmd(550, "MKD link/dir")
+	client.cmd(550, "DELE link/host")
+
+	if _, err := os.Stat(filepath.Join(outside, "host")); err != nil {
+		t.Fatalf("file outside Root removed: %v", err)
+	}
+
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Fatalf("%d entries outside Root", len(entries))
+	}
+
+	// Symlinks staying inside Root are followed
+	if got := client.download("RETR inside/file"); string(got) != "inside" {
+		t.Fatalf("RETR through a symlink %q", got)
+	}
+}
+
+func TestDirBackendFailedUpload(t *testing.T) {
+	server, root := newDirServer(t, WithPassiveTimeout(100*time.Millisecond))
+	os.WriteFile(filepath.Join(root, "file"), []byte("precious"), 0644)
+
+	client := dialServer(t, server)
+	client.login()
+
+	for _, command := range []string{"STOR file", "APPE file"} {
+		client.cmd(229, "EPSV")
+		client.cmd(150, "%s", command)
+		client.expect(425)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(root, "file"))
+	if string(data) != "precious" {
+		t.Fatalf("file changed to %q", data)
+	}
+
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Fatalf("%d entries on disk, temporary files left", len(entries))
+	}
+}
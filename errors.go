@@ -5,13 +5,28 @@ import (
 )
 
 var (
-	ErrQuitRequest = errors.New("Client requested to close the connection")
+	ErrQuitRequest  = errors.New("Client requested to close the connection")
+	ErrServerClosed = errors.New("Server closed")
 
 	ErrNotFound      = errors.New("File not found")
 	ErrAlreadyExists = errors.New("File already exists")
 	ErrNoParent      = errors.New("Parent not found")
+	ErrRootDirectory = errors.New("Root directory can not be changed")
+	ErrMoveIntoSelf  = errors.New("Directory can not be moved into itself")
+	ErrInvalidOffset = errors.New("Invalid offset")
+
+	ErrPermissionDenied = errors.New("Permission denied")
+	ErrActionFailed     = errors.New("Action not taken")
+
+	ErrAuthenticationFailed = errors.New("Authentication failed")
+	ErrInvalidTLSConfig     = errors.New("TLS config has no certificate")
 
-	ErrProtocolNotSupported  = errors.New("Network protocol not supported, use (1,2)")
 	ErrInvalidMessage        = errors.New("Invalid message")
 	ErrDataSocketUnavailable = errors.New("Data socket unavailable")
+	ErrNoPassivePort         = errors.New("No passive port available")
+	ErrInvalidPortRange      = errors.New("Invalid port range")
+
+	// Deprecated: EPRT replies 522 to an unsupported network protocol and
+	// no longer returns this error.
+	ErrProtocolNotSupported = errors.New("Network protocol not supported, use (1,2)")
 )
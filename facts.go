@@ -0,0 +1,118 @@
+package ftptest
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/jehiah/go-strftime"
+)
+
+// Facts of MLST and MLSD replies in the order they are sent (RFC 3659)
+var mlstFacts = []string{"type", "size", "modify", "perm", "unique", "unix.mode"}
+
+// Formats the facts the client selected with OPTS MLST, followed by the name
+func (c *Connection) mlstEntry(file *File, virtual string, name string) string {
+	var entry strings.Builder
+
+	for _, fact := range c.mlstSelectedFacts() {
+		value := ""
+
+		switch fact {
+		case "type":
+			value = "file"
+			if file.Type == "directory" {
+				value = "dir"
+			}
+		case "size":
+			value = strconv.FormatInt(file.Size, 10)
+		case "modify":
+			value = strftime.Format("%Y%m%d%H%M%S", file.TimeModified.UTC())
+		case "perm":
+			value = c.mlstPerm(file, virtual)
+		case "unique":
+			hash := fnv.New64a()
+			hash.Write([]byte(c.RealPath(virtual)))
+			value = strconv.FormatUint(hash.Sum64(), 16)
+		case "unix.mode":
+			value = "0" + strconv.FormatUint(uint64(file.Mode.Perm()), 8)
+		}
+
+		entry.WriteString(mlstFactName(fact) + "=" + value + ";")
+	}
+
+	return entry.String() + " " + name
+}
+
+// Facts selected with OPTS MLST, all of them by default
+func (c *Connection) mlstSelectedFacts() []string {
+	if c.MLSTFacts == nil {
+		return mlstFacts
+	}
+
+	return c.MLSTFacts
+}
+
+// The perm fact, what the user may do with the file according to permissions
+func (c *Connection) mlstPerm(file *File, virtual string) string {
+	var perm strings.Builder
+
+	allow := func(permission Permission, letters string) {
+		if c.Allows(permission, virtual) {
+			perm.WriteString(letters)
+		}
+	}
+
+	if file.Type == "directory" {
+		perm.WriteString("e")
+		allow(PermList, "l")
+		allow(PermWrite, "c")
+		allow(PermMkDir, "m")
+		allow(PermDelete, "dp")
+	} else {
+		allow(PermRead, "r")
+		allow(PermWrite, "aw")
+		allow(PermDelete, "d")
+	}
+
+	allow(PermRename, "f")
+	return perm.String()
+}
+
+// Selects facts from a list like "type;size;", unknown ones are ignored
+func (c *Connection) selectMLSTFacts(list string) []string {
+	requested := map[string]bool{}
+	for _, fact := range strings.Split(strings.ToLower(list), ";") {
+		requested[strings.TrimSpace(fact)] = true
+	}
+
+	selected := make([]string, 0)
+	for _, fact := range mlstFacts {
+		if requested[fact] {
+			selected = append(selected, fact)
+		}
+	}
+
+	c.MLSTFacts = selected
+	return selected
+}
+
+// Joins facts the way OPTS MLST confirms them, e.g. "type;size;"
+func joinMLSTFacts(facts []string) string {
+	var list strings.Builder
+
+	for _, fact := range facts {
+		list.WriteString(mlstFactName(fact) + ";")
+	}
+
+	return list.String()
+}
+
+// Facts are case insensitive, UNIX.mode is conventionally written like this
+func mlstFactName(fact string) string {
+	if fact == "unix.mode" {
+		return "UNIX.mode"
+	}
+
+	return fact
+}
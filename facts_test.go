@@ -0,0 +1,31 @@
+package ftptest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMachineListings(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.MkDir("/dir")
+	server.Filesystem.WriteFile("/file", []byte("data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	message := client.cmd(250, "MLST file")
+	if !strings.Contains(message, "type=file;size=4;") || !strings.Contains(message, "UNIX.mode=0644;") || !strings.HasSuffix(message, " /file\nEnd") {
+		t.Fatalf("MLST %q", message)
+	}
+
+	if message := client.cmd(200, "OPTS MLST type;size;bogus;"); message != "MLST OPTS type;size;" {
+		t.Fatalf("OPTS MLST %q", message)
+	}
+
+	listing := string(client.download("MLSD"))
+	if listing != "type=dir;size=4096; dir\r\ntype=file;size=4; file\r\n" {
+		t.Fatalf("MLSD %q", listing)
+	}
+
+	client.cmd(550, "MLST missing")
+}
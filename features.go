@@ -0,0 +1,96 @@
+package ftptest
+
+import (
+	"strings"
+)
+
+// Extensions listed by FEAT, each only while the command providing it is
+// enabled. An empty feature is left out.
+var features = []struct {
+	command string
+	feature func(conn *Connection) string
+}{
+	{"AUTH", featureAUTH},
+	{"EPRT", feature("EPRT")},
+	{"EPSV", feature("EPSV")},
+	{"MDTM", feature("MDTM")},
+	{"MLST", featureMLST},
+	{"MODE", feature("MODE Z")},
+	{"PBSZ", featureTLS("PBSZ")},
+	{"PROT", featureTLS("PROT")},
+	{"REST", feature("REST STREAM")},
+	{"SIZE", feature("SIZE")},
+	{"UTF8", featureUTF8},
+}
+
+// A feature which is always available with its command
+func feature(name string) func(conn *Connection) string {
+	return func(conn *Connection) string {
+		return name
+	}
+}
+
+// A feature which needs a TLS config on the server
+func featureTLS(name string) func(conn *Connection) string {
+	return func(conn *Connection) string {
+		if conn.Server.TLSConfig == nil {
+			return ""
+		}
+
+		return name
+	}
+}
+
+// AUTH TLS, pointless with implicit TLS where the connection is already secure
+func featureAUTH(conn *Connection) string {
+	if conn.Server.TLSConfig == nil || conn.Server.ImplicitTLS {
+		return ""
+	}
+
+	return "AUTH TLS"
+}
+
+// MLST with the facts it knows, those currently selected are marked with *
+func featureMLST(conn *Connection) string {
+	selected := map[string]bool{}
+	for _, fact := range conn.mlstSelectedFacts() {
+		selected[fact] = true
+	}
+
+	var list strings.Builder
+	for _, fact := range mlstFacts {
+		list.WriteString(mlstFactName(fact))
+		if selected[fact] {
+			list.WriteString("*")
+		}
+		list.WriteString(";")
+	}
+
+	return "MLST " + list.String()
+}
+
+// UTF8 is switched on with OPTS, so it needs that command too
+func featureUTF8(conn *Connection) string {
+	if !conn.Server.commandEnabled("OPTS") {
+		return ""
+	}
+
+	return "UTF8"
+}
+
+// Extensions the server currently offers, for FEAT
+func (c *Connection) featureList() []string {
+	var list []string
+
+	for _, entry := range features {
+		if !c.Server.commandEnabled(entry.command) {
+			continue
+		}
+
+		if name := entry.feature(c); name != "" {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
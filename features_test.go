@@ -0,0 +1,43 @@
+package ftptest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	serverConfig, _ := testCertificate(t)
+
+	server := NewServer(t, WithTLS(serverConfig))
+
+	client := dialServer(t, server)
+	client.cmd(200, "OPTS MLST type;size;")
+
+	message := client.cmd(211, "FEAT")
+	for _, feature := range []string{"AUTH TLS", "EPSV", "MDTM", "MLST type*;size*;modify;perm;unique;UNIX.mode;", "MODE Z", "PBSZ", "PROT", "REST STREAM", "SIZE", "UTF8"} {
+		if !strings.Contains(message, "\n "+feature+"\n") {
+			t.Errorf("FEAT does not list %q: %q", feature, message)
+		}
+	}
+
+	client.cmd(200, "OPTS UTF8 ON")
+	client.cmd(501, "OPTS BOGUS")
+}
+
+func TestDisabledCommands(t *testing.T) {
+	server := NewServer(t, WithDisabledCommands("epsv", "SIZE", "UTF8"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(500, "EPSV")
+	client.cmd(500, "SIZE file")
+	client.cmd(501, "OPTS UTF8 ON")
+
+	message := client.cmd(211, "FEAT")
+	for _, feature := range []string{"EPSV", "SIZE", "UTF8", "AUTH TLS"} {
+		if strings.Contains(message, " "+feature+"\n") {
+			t.Errorf("FEAT lists disabled %q: %q", feature, message)
+		}
+	}
+}
@@ -1,58 +1,96 @@
 package ftptest
 
 import (
+	"io"
 	"os"
 	filepath "path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// In-memory filesystem, a tree of directories rooted at "/". The zero value
+// is an empty filesystem, same as NewFilesystem.
 type Filesystem struct {
-	Directories []string
-	Files       map[string]*File
-	Mutex       sync.RWMutex
+	Mutex sync.RWMutex
+
+	// Where uploads are kept, in memory when nil
+	Storage Storage
+
+	root     *File
+	rootOnce sync.Once
 }
 
 type File struct {
 	Name         string
 	Type         string
+	TimeCreated  time.Time
 	TimeModified time.Time
-	Size         int
-	Content      []byte
+	Size         int64
+	Content      Content
+	Owner        string
+	Group        string
+	Mode         os.FileMode
+
+	// Entries of a directory by name
+	children map[string]*File
 }
 
-// File modes
+// Permissions of new files and directories
+var (
+	FileMode os.FileMode = 0644
+	DirMode  os.FileMode = 0755
+)
+
+// Owner and group of new files and directories
 var (
-	FileMode os.FileMode = 644
-	DirMode  os.FileMode = 755
+	DefaultOwner = "owner"
+	DefaultGroup = "group"
 )
 
+// Size reported for directories, as on most Unix filesystems
+const directorySize = 4096
+
+// Creates an empty filesystem with only the root directory
+func NewFilesystem() *Filesystem {
+	return &Filesystem{}
+}
+
+func newDirectory(name string) *File {
+	now := time.Now()
+
+	return &File{
+		Name:         name,
+		Type:         "directory",
+		TimeCreated:  now,
+		TimeModified: now,
+		Size:         directorySize,
+		Owner:        DefaultOwner,
+		Group:        DefaultGroup,
+		Mode:         os.ModeDir | DirMode,
+		children:     map[string]*File{},
+	}
+}
+
 // Create a new directory
 func (f *Filesystem) MkDir(path string) error {
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
 
-	if err := f.DirExists(path); err == nil {
-		return ErrAlreadyExists
+	parent, err := f.lookupDir(filepath.Dir(path))
+	if err != nil {
+		return ErrNotFound
 	}
 
-	parent := filepath.Dir(path)
-
-	if parent != "." && parent != "/" {
-		parents := strings.Split(parent, "/")
-		for i, _ := range parents {
-			path := strings.Join(parents[:i], "/")
-
-			if err := f.DirExists(path); err != nil {
-				return ErrNotFound
-			}
-		}
+	name := filepath.Base(path)
+	if _, exists := parent.children[name]; exists || name == "/" {
+		return ErrAlreadyExists
 	}
 
-	f.Directories = append(f.Directories, filepath.Clean(path))
+	parent.children[name] = newDirectory(name)
+	parent.touch()
 	return nil
-
 }
 
 // Recursively remove a directory
@@ -60,44 +98,134 @@ func (f *Filesystem) RmDir(path string) error {
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
 
-	if err := f.DirExists(path); err != nil {
+	if _, err := f.lookupDir(path); err != nil {
 		return ErrNotFound
 	}
 
-	for name, _ := range f.Files {
-		if strings.HasPrefix(name, filepath.Clean(path)) {
-			delete(f.Files, name)
-		}
-	}
-
-	for i, directory := range f.Directories {
-		if strings.HasPrefix(directory, filepath.Clean(path)) {
-			f.Directories = f.Directories[:i+copy(f.Directories[i:], f.Directories[i+1:])]
-		}
+	if filepath.Clean(path) == "/" {
+		return ErrRootDirectory
 	}
 
+	parent, _ := f.lookupDir(filepath.Dir(path))
+	releaseTree(parent.children[filepath.Base(path)])
+	delete(parent.children, filepath.Base(path))
+	parent.touch()
 	return nil
 }
 
 // Write a file
 func (f *Filesystem) WriteFile(path string, data []byte) error {
+	return f.WriteContent(path, BytesContent(data))
+}
+
+// Write a file backed by any content, e.g. SyntheticContent
+func (f *Filesystem) WriteContent(path string, content Content) error {
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
 
-	dir := filepath.Dir(path)
+	return f.putFile(path, content)
+}
+
+// Create a file streamed into storage, it appears once the writer is closed
+func (f *Filesystem) Create(path string) (io.WriteCloser, error) {
+	return f.CreateAt(path, 0)
+}
+
+// Like Create, but the first offset bytes of the existing file are kept
+func (f *Filesystem) CreateAt(path string, offset int64) (io.WriteCloser, error) {
+	if err := f.DirExists(filepath.Dir(path)); err != nil {
+		return nil, ErrNoParent
+	}
+
+	var existing Content
+	if offset > 0 {
+		file, err := f.ReadFile(path)
+		if err != nil || offset > file.Size {
+			return nil, ErrInvalidOffset
+		}
+
+		existing = file.Content
+	}
+
+	storage := f.Storage
+	if storage == nil {
+		storage = MemoryStorage{}
+	}
+
+	writer, err := storage.Create()
+	if err != nil {
+		return nil, err
+	}
 
-	if err := f.DirExists(dir); err != nil {
+	if existing != nil {
+		if err := copyPrefix(writer, existing, offset); err != nil {
+			writer.Close()
+			return nil, err
+		}
+	}
+
+	return &fileWriter{filesystem: f, path: path, writer: writer}, nil
+}
+
+// Copies the first bytes of the content into a writer
+func copyPrefix(writer io.Writer, content Content, length int64) error {
+	reader, err := content.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.CopyN(writer, reader, length)
+	return err
+}
+
+// Open a file for streaming its content
+func (f *Filesystem) Open(path string) (io.ReadSeekCloser, error) {
+	file, err := f.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.Content.Open()
+}
+
+// Stores a file, the caller holds the lock
+func (f *Filesystem) putFile(path string, content Content) error {
+	parent, err := f.lookupDir(filepath.Dir(path))
+	if err != nil {
 		return ErrNoParent
 	}
 
-	f.Files[path] = &File{
+	name := filepath.Base(path)
+	existing, exists := parent.children[name]
+	if exists && existing.Type == "directory" {
+		return ErrAlreadyExists
+	}
+
+	now := time.Now()
+	file := &File{
 		Type:         "file",
-		Name:         filepath.Base(path),
-		TimeModified: time.Now(),
-		Size:         len(data),
-		Content:      data,
+		Name:         name,
+		TimeCreated:  now,
+		TimeModified: now,
+		Size:         content.Size(),
+		Content:      content,
+		Owner:        DefaultOwner,
+		Group:        DefaultGroup,
+		Mode:         FileMode,
 	}
 
+	// Overwriting keeps ownership and permissions, like on Unix
+	if exists {
+		file.TimeCreated = existing.TimeCreated
+		file.Owner = existing.Owner
+		file.Group = existing.Group
+		file.Mode = existing.Mode
+		releaseContent(existing.Content)
+	}
+
+	parent.children[name] = file
+	parent.touch()
 	return nil
 }
 
@@ -106,22 +234,19 @@ func (f *Filesystem) ReadFile(path string) (*File, error) {
 	f.Mutex.RLock()
 	defer f.Mutex.RUnlock()
 
-	file, exists := f.Files[path]
-	if !exists {
+	file := f.lookup(path)
+	if file == nil || file.Type != "file" {
 		return nil, ErrNotFound
 	}
 
-	return file, nil
+	return file.snapshot(), nil
 }
 
 // Read file size
-func (f *Filesystem) Size(path string) (int, error) {
-	f.Mutex.RLock()
-	defer f.Mutex.RUnlock()
-
-	file, exists := f.Files[path]
-	if !exists {
-		return 0, ErrNotFound
+func (f *Filesystem) Size(path string) (int64, error) {
+	file, err := f.ReadFile(path)
+	if err != nil {
+		return 0, err
 	}
 
 	return file.Size, nil
@@ -129,102 +254,280 @@ func (f *Filesystem) Size(path string) (int, error) {
 
 // Read last modified
 func (f *Filesystem) LastModified(path string) (time.Time, error) {
+	file, err := f.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return file.TimeModified, nil
+}
+
+// File or directory metadata
+func (f *Filesystem) Stat(path string) (*File, error) {
 	f.Mutex.RLock()
 	defer f.Mutex.RUnlock()
 
-	file, exists := f.Files[path]
-	if !exists {
-		return time.Time{}, ErrNotFound
+	file := f.lookup(path)
+	if file == nil {
+		return nil, ErrNotFound
 	}
 
-	return file.TimeModified, nil
+	return file.snapshot(), nil
+}
+
+// Directory contents, same as DirContents
+func (f *Filesystem) List(path string) ([]*File, error) {
+	return f.DirContents(path)
 }
 
 // Directory exists?
 func (f *Filesystem) DirExists(path string) error {
-	for _, directory := range f.Directories {
-		if directory == path {
-			return nil
-		}
-	}
+	f.Mutex.RLock()
+	defer f.Mutex.RUnlock()
 
-	return ErrNotFound
+	_, err := f.lookupDir(path)
+	return err
 }
 
 // Remove a file
 func (f *Filesystem) Remove(path string) error {
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
-	_, exists := f.Files[path]
-	if !exists {
+
+	file := f.lookup(path)
+	if file == nil || file.Type != "file" {
 		return ErrNotFound
 	}
 
-	delete(f.Files, path)
+	parent, _ := f.lookupDir(filepath.Dir(path))
+	delete(parent.children, file.Name)
+	parent.touch()
+	releaseContent(file.Content)
 	return nil
 }
 
-// Directory contents
+// Directory contents, sorted by name
 func (f *Filesystem) DirContents(path string) ([]*File, error) {
 	f.Mutex.RLock()
 	defer f.Mutex.RUnlock()
 
-	if err := f.DirExists(path); err != nil {
+	directory, err := f.lookupDir(path)
+	if err != nil {
 		return nil, ErrNotFound
 	}
 
-	response := make([]*File, 0)
-
-	for name, file := range f.Files {
-		if strings.HasPrefix(name, path) {
-			if parts := strings.Split(name[len(path):], "/"); len(parts) == 1 {
-				response = append(response, file)
-			}
-		}
+	response := make([]*File, 0, len(directory.children))
+	for _, file := range directory.children {
+		response = append(response, file.snapshot())
 	}
 
-	for _, directory := range f.Directories {
-		if strings.HasPrefix(directory, path) {
-			if parts := strings.Split(directory[len(path):], "/"); len(parts) == 1 {
-				response = append(response, &File{
-					Type: "directory",
-					Name: filepath.Base(path),
-				})
-			}
-		}
-	}
+	sort.Slice(response, func(i, j int) bool {
+		return response[i].Name < response[j].Name
+	})
 
 	return response, nil
 }
 
-// File renaming
+// Renames or moves a file or a directory with everything in it
 func (f *Filesystem) Rename(from string, to string) error {
 	f.Mutex.Lock()
 	defer f.Mutex.Unlock()
 
-	dir := filepath.Dir(to)
-	if err := f.DirExists(dir); err != nil {
+	if from == "" {
 		return ErrNotFound
 	}
 
-	file, err := f.ReadFile(from)
-	if err != nil {
-		return err
+	from = filepath.Clean("/" + from)
+	to = filepath.Clean("/" + to)
+
+	file := f.lookup(from)
+	if file == nil || from == "/" {
+		return ErrNotFound
+	}
+
+	if to == "/" {
+		return ErrAlreadyExists
+	}
+
+	// A directory can not be moved into itself
+	if file.Type == "directory" && hasPathPrefix(to, from) {
+		return ErrMoveIntoSelf
 	}
 
-	err = f.Remove(from)
+	parent, err := f.lookupDir(filepath.Dir(to))
 	if err != nil {
-		return err
+		return ErrNotFound
+	}
+
+	name := filepath.Base(to)
+	if existing, exists := parent.children[name]; exists && (existing.Type == "directory" || file.Type == "directory") {
+		return ErrAlreadyExists
+	}
+
+	// A file moved over another one replaces it
+	if existing, exists := parent.children[name]; exists && existing != file {
+		releaseContent(existing.Content)
+	}
+
+	source, _ := f.lookupDir(filepath.Dir(from))
+	delete(source.children, file.Name)
+	source.touch()
+
+	file.Name = name
+	parent.children[name] = file
+	parent.touch()
+	return nil
+}
+
+// Changes the owner and group of a file or directory
+func (f *Filesystem) Chown(path string, owner string, group string) error {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	file := f.lookup(path)
+	if file == nil {
+		return ErrNotFound
+	}
+
+	file.Owner = owner
+	file.Group = group
+	return nil
+}
+
+// Changes the permission bits of a file or directory
+func (f *Filesystem) Chmod(path string, mode os.FileMode) error {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	file := f.lookup(path)
+	if file == nil {
+		return ErrNotFound
+	}
+
+	file.Mode = file.Mode&^os.ModePerm | mode&os.ModePerm
+	return nil
+}
+
+// Sets the permissions and modification time of a file or directory, zero
+// values are left alone
+func (f *Filesystem) setMetadata(path string, mode os.FileMode, modified time.Time) error {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	file := f.lookup(path)
+	if file == nil {
+		return ErrNotFound
+	}
+
+	if mode.Perm() != 0 {
+		file.Mode = file.Mode&^os.ModePerm | mode.Perm()
+	}
+
+	if !modified.IsZero() {
+		file.TimeModified = modified
+	}
+
+	return nil
+}
+
+// Walks the tree down to the path, nil when missing. The caller holds the lock.
+func (f *Filesystem) lookup(path string) *File {
+	// The root is created on first use, so the zero value works too
+	f.rootOnce.Do(func() {
+		f.root = newDirectory("/")
+	})
+
+	current := f.root
+
+	for _, name := range strings.Split(filepath.Clean("/"+path), "/") {
+		if name == "" {
+			continue
+		}
+
+		if current.Type != "directory" {
+			return nil
+		}
+
+		current = current.children[name]
+		if current == nil {
+			return nil
+		}
+	}
+
+	return current
+}
+
+// Like lookup, but only finds directories
+func (f *Filesystem) lookupDir(path string) (*File, error) {
+	directory := f.lookup(path)
+	if directory == nil || directory.Type != "directory" {
+		return nil, ErrNotFound
+	}
+
+	return directory, nil
+}
+
+// Releases the content of a file, or of every file below a directory
+func releaseTree(file *File) {
+	if file.Type == "file" {
+		releaseContent(file.Content)
+		return
+	}
+
+	for _, child := range file.children {
+		releaseTree(child)
 	}
+}
 
-	return f.WriteFile(to, file.Content)
+// Marks a directory as modified after its entries changed
+func (f *File) touch() {
+	f.TimeModified = time.Now()
 }
 
-// Returns a mode string from the os module
+// Copy of the metadata that is safe to hand out of the lock
+func (f *File) snapshot() *File {
+	file := *f
+	file.children = nil
+	return &file
+}
+
+// Returns a mode string from the os module, e.g. drwxr-xr-x
 func (f *File) ModeString() string {
+	mode := f.Mode
 	if f.Type == "directory" {
-		return DirMode.String()
+		mode |= os.ModeDir
+	}
+
+	return mode.String()
+}
+
+// Commits an upload to the filesystem when closed, Abort drops it
+type fileWriter struct {
+	filesystem *Filesystem
+	path       string
+	writer     ContentWriter
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if err := w.writer.Close(); err != nil {
+		releaseContent(w.writer.Content())
+		return err
 	}
 
-	return FileMode.String()
+	if err := w.filesystem.WriteContent(w.path, w.writer.Content()); err != nil {
+		releaseContent(w.writer.Content())
+		return err
+	}
+
+	return nil
+}
+
+func (w *fileWriter) Abort() error {
+	err := w.writer.Close()
+	releaseContent(w.writer.Content())
+	return err
 }
@@ -0,0 +1,125 @@
+package ftptest
+
+import "testing"
+
+func TestFilesystemTree(t *testing.T) {
+	filesystem := NewFilesystem()
+
+	for _, path := range []string{"/foo", "/foobar", "/foo/bar", "/foo/bar/baz"} {
+		if err := filesystem.MkDir(path); err != nil {
+			t.Fatalf("MkDir(%s): %v", path, err)
+		}
+	}
+
+	if err := filesystem.MkDir("/missing/dir"); err != ErrNotFound {
+		t.Fatalf("MkDir without parent: %v", err)
+	}
+
+	if err := filesystem.MkDir("/foo"); err != ErrAlreadyExists {
+		t.Fatalf("MkDir of an existing directory: %v", err)
+	}
+
+	filesystem.WriteFile("/foo/file", []byte("data"))
+
+	files, err := filesystem.DirContents("/foo")
+	if err != nil {
+		t.Fatalf("DirContents: %v", err)
+	}
+
+	if len(files) != 2 || files[0].Name != "bar" || files[1].Name != "file" {
+		t.Fatalf("DirContents(/foo) = %v", files)
+	}
+
+	// Removing /foo leaves /foobar alone
+	if err := filesystem.RmDir("/foo"); err != nil {
+		t.Fatalf("RmDir: %v", err)
+	}
+
+	if err := filesystem.DirExists("/foobar"); err != nil {
+		t.Fatalf("/foobar removed with /foo")
+	}
+
+	if _, err := filesystem.Stat("/foo/bar/baz"); err != ErrNotFound {
+		t.Fatalf("Stat below a removed directory: %v", err)
+	}
+
+	if err := filesystem.RmDir("/"); err != ErrRootDirectory {
+		t.Fatalf("RmDir(/): %v", err)
+	}
+}
+
+func TestFilesystemRename(t *testing.T) {
+	filesystem := NewFilesystem()
+	filesystem.MkDir("/a")
+	filesystem.MkDir("/a/b")
+	filesystem.WriteFile("/a/b/file", []byte("data"))
+
+	if err := filesystem.Rename("/a", "/c"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if got := readFile(t, filesystem, "/c/b/file"); got != "data" {
+		t.Fatalf("moved file %q", got)
+	}
+
+	tests := []struct {
+		from string
+		to   string
+		err  error
+	}{
+		{"/c", "/c/b/d", ErrMoveIntoSelf},
+		{"", "/c/z", ErrNotFound},
+		{"/", "/c/z", ErrNotFound},
+		{"/c/b", "/", ErrAlreadyExists},
+		{"/missing", "/z", ErrNotFound},
+	}
+
+	for _, test := range tests {
+		if err := filesystem.Rename(test.from, test.to); err != test.err {
+			t.Errorf("Rename(%q, %q) = %v, want %v", test.from, test.to, err, test.err)
+		}
+	}
+}
+
+func TestFilesystemZeroValue(t *testing.T) {
+	var filesystem Filesystem
+
+	if err := filesystem.MkDir("/dir"); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	server := NewServer(t, WithFilesystem(&Filesystem{}))
+
+	client := dialServer(t, server)
+	client.login()
+	client.cmd(257, "MKD dir")
+	client.cmd(250, "CWD dir")
+}
+
+func TestFilesystemMetadata(t *testing.T) {
+	filesystem := NewFilesystem()
+	filesystem.MkDir("/dir")
+
+	before, _ := filesystem.Stat("/dir")
+
+	filesystem.WriteFile("/dir/file", []byte("data"))
+	filesystem.Chown("/dir/file", "alice", "staff")
+	filesystem.Chmod("/dir/file", 0600)
+
+	after, _ := filesystem.Stat("/dir")
+	if !after.TimeModified.After(before.TimeModified) {
+		t.Error("directory not modified when a file was added")
+	}
+
+	if after.ModeString() != "drwxr-xr-x" {
+		t.Errorf("directory mode %s", after.ModeString())
+	}
+
+	// Overwriting keeps owner and mode
+	filesystem.WriteFile("/dir/file", []byte("new"))
+
+	file, _ := filesystem.Stat("/dir/file")
+	if file.Owner != "alice" || file.Group != "staff" || file.ModeString() != "-rw-------" {
+		t.Errorf("overwritten file has %s %s %s", file.Owner, file.Group, file.ModeString())
+	}
+}
@@ -0,0 +1,243 @@
+package ftptest
+
+import (
+	"io"
+	"io/fs"
+	filepath "path"
+	"sort"
+	"time"
+)
+
+// Builds an in-memory filesystem from any fs.FS, e.g. embed.FS or
+// fstest.MapFS, so fixtures can be declared once and served in tests.
+// Modification times and permissions are copied, entries without
+// permissions, like MapFS entries without a Mode, keep the defaults.
+func NewFilesystemFromFS(fsys fs.FS) (*Filesystem, error) {
+	filesystem := NewFilesystem()
+
+	// Adding entries modifies the directories, so they get their metadata
+	// once the walk is done
+	directories := make(map[string]fs.FileInfo)
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join("/", name)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if path == "/" {
+				return nil
+			}
+
+			directories[path] = info
+			return filesystem.MkDir(path)
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		if err := filesystem.WriteFile(path, data); err != nil {
+			return err
+		}
+
+		return filesystem.setMetadata(path, info.Mode(), info.ModTime())
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for path, info := range directories {
+		if err := filesystem.setMetadata(path, info.Mode(), info.ModTime()); err != nil {
+			return nil, err
+		}
+	}
+
+	return filesystem, nil
+}
+
+// Read-only io/fs view of the filesystem, it implements fs.ReadDirFS and
+// fs.StatFS as well. Filesystem is not an fs.FS itself because its Open,
+// part of Backend, returns an io.ReadSeekCloser rather than an fs.File.
+func (f *Filesystem) FS() fs.FS {
+	return filesystemFS{f}
+}
+
+type filesystemFS struct {
+	filesystem *Filesystem
+}
+
+// Maps an io/fs name to a filesystem path
+func (f filesystemFS) path(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return filepath.Join("/", name), nil
+}
+
+func (f filesystemFS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		entries, err := f.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &fsDir{info: info, entries: entries}, nil
+	}
+
+	reader, err := info.file.Content.Open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &fsFile{info: info, ReadSeekCloser: reader}, nil
+}
+
+func (f filesystemFS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f filesystemFS) stat(op string, name string) (*fileInfo, error) {
+	path, err := f.path(op, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := f.filesystem.Stat(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	info := &fileInfo{file: file, name: file.Name}
+	if name == "." {
+		info.name = "."
+	}
+
+	return info, nil
+}
+
+func (f filesystemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := f.filesystem.List(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(contents))
+	for _, file := range contents {
+		entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{file: file, name: file.Name}))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// fs.FileInfo of a File
+type fileInfo struct {
+	file *File
+	name string
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.file.Size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return i.file.Mode | fs.ModeDir
+	}
+
+	return i.file.Mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.file.TimeModified
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.file.Type == "directory"
+}
+
+func (i *fileInfo) Sys() interface{} {
+	return i.file
+}
+
+// Regular file opened through io/fs
+type fsFile struct {
+	io.ReadSeekCloser
+	info *fileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Directory opened through io/fs
+type fsDir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+
+	d.offset += n
+	return remaining[:n], nil
+}
+
+var (
+	_ fs.ReadDirFS = filesystemFS{}
+	_ fs.StatFS    = filesystemFS{}
+)
@@ -0,0 +1,85 @@
+package ftptest
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFilesystemFromFS(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	fixtures := fstest.MapFS{
+		"readme.txt":         {Data: []byte("hello"), ModTime: modified},
+		"data/a.csv":         {Data: []byte("a,b\n")},
+		"data/nested/b.json": {Data: []byte("{}")},
+		"empty":              {Mode: fs.ModeDir},
+		"secret":             {Data: []byte("key"), Mode: 0600},
+		"private":            {Mode: fs.ModeDir | 0700, ModTime: modified},
+		"private/file":       {Data: []byte("data")},
+	}
+
+	filesystem, err := NewFilesystemFromFS(fixtures)
+	if err != nil {
+		t.Fatalf("NewFilesystemFromFS: %v", err)
+	}
+
+	if got := readFile(t, filesystem, "/data/nested/b.json"); got != "{}" {
+		t.Fatalf("b.json %q", got)
+	}
+
+	if file, _ := filesystem.Stat("/readme.txt"); !file.TimeModified.Equal(modified) {
+		t.Fatalf("readme.txt modified %s", file.TimeModified)
+	}
+
+	if err := filesystem.DirExists("/empty"); err != nil {
+		t.Fatalf("empty directory missing: %v", err)
+	}
+
+	modes := map[string]string{
+		"/readme.txt": "-rw-r--r--",
+		"/secret":     "-rw-------",
+		"/private":    "drwx------",
+		"/data":       "dr-xr-xr-x",
+	}
+
+	for path, want := range modes {
+		if file, _ := filesystem.Stat(path); file.ModeString() != want {
+			t.Errorf("%s has mode %s, want %s", path, file.ModeString(), want)
+		}
+	}
+
+	// Adding the file does not touch the directory afterwards
+	if file, _ := filesystem.Stat("/private"); !file.TimeModified.Equal(modified) {
+		t.Errorf("private modified %s", file.TimeModified)
+	}
+
+	if err := fstest.TestFS(filesystem.FS(), "readme.txt", "data/a.csv", "data/nested/b.json", "empty", "secret", "private/file"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSSeesUploads(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+	client.cmd(257, "MKD dir")
+	client.upload("STOR dir/upload", []byte("uploaded"))
+
+	data, err := fs.ReadFile(server.Filesystem.FS(), "dir/upload")
+	if err != nil || string(data) != "uploaded" {
+		t.Fatalf("ReadFile %q (%v)", data, err)
+	}
+
+	var paths []string
+	fs.WalkDir(server.Filesystem.FS(), ".", func(path string, entry fs.DirEntry, err error) error {
+		paths = append(paths, path)
+		return err
+	})
+
+	if len(paths) != 3 {
+		t.Fatalf("WalkDir visited %v", paths)
+	}
+}
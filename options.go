@@ -0,0 +1,193 @@
+package ftptest
+
+import (
+	"crypto/tls"
+	filepath "path"
+	"strings"
+	"time"
+)
+
+// Option configures an FTPServer created with NewFTPServer
+type Option func(*FTPServer) error
+
+// Address the server listens on, defaults to 127.0.0.1:0
+func WithAddress(address string) Option {
+	return func(f *FTPServer) error {
+		f.address = address
+		return nil
+	}
+}
+
+// Use a pre-built filesystem instead of an empty one
+func WithFilesystem(filesystem *Filesystem) Option {
+	return func(f *FTPServer) error {
+		f.Filesystem = filesystem
+		return nil
+	}
+}
+
+// Serve files from another backend, e.g. a DirBackend, instead of the
+// in-memory filesystem
+func WithBackend(backend Backend) Option {
+	return func(f *FTPServer) error {
+		f.Backend = backend
+		return nil
+	}
+}
+
+// Turns commands off, so clients see them as unknown and FEAT no longer
+// lists them. Options of OPTS, e.g. "UTF8", are turned off the same way.
+func WithDisabledCommands(names ...string) Option {
+	return func(f *FTPServer) error {
+		if f.DisabledCommands == nil {
+			f.DisabledCommands = map[string]bool{}
+		}
+
+		for _, name := range names {
+			f.DisabledCommands[strings.ToUpper(name)] = true
+		}
+
+		return nil
+	}
+}
+
+// Greeting sent to new connections. Multiple lines produce a multi-line reply.
+func WithWelcome(lines ...string) Option {
+	return func(f *FTPServer) error {
+		f.Welcome = lines
+		return nil
+	}
+}
+
+// Closes control connections which did not send a command within the timeout
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(f *FTPServer) error {
+		f.IdleTimeout = timeout
+		return nil
+	}
+}
+
+// Limits how long active data connections may take to open and how long
+// any data connection may stay silent
+func WithDataTimeout(timeout time.Duration) Option {
+	return func(f *FTPServer) error {
+		f.DataTimeout = timeout
+		return nil
+	}
+}
+
+// Verify logins with the authenticator instead of accepting everyone
+func WithAuthenticator(authenticator Authenticator) Option {
+	return func(f *FTPServer) error {
+		f.Authenticator = authenticator
+		return nil
+	}
+}
+
+// Jails the user into a directory of the filesystem, which must exist
+func WithHome(user string, home string) Option {
+	return func(f *FTPServer) error {
+		if f.Homes == nil {
+			f.Homes = map[string]string{}
+		}
+
+		f.Homes[user] = home
+		return nil
+	}
+}
+
+// Limits what the user may do everywhere, unless overridden for a path
+func WithPermissions(user string, permission Permission) Option {
+	return func(f *FTPServer) error {
+		f.userPermissions(user).Default = permission
+		return nil
+	}
+}
+
+// Limits what the user may do within a path, as seen by the user
+func WithPathPermissions(user string, path string, permission Permission) Option {
+	return func(f *FTPServer) error {
+		f.userPermissions(user).Paths[filepath.Clean("/"+path)] = permission
+		return nil
+	}
+}
+
+// Enables AUTH TLS using the config, see GenerateCertificate
+func WithTLS(config *tls.Config) Option {
+	return func(f *FTPServer) error {
+		if !hasCertificate(config) {
+			return ErrInvalidTLSConfig
+		}
+
+		f.TLSConfig = config
+		return nil
+	}
+}
+
+// Implicit FTPS, TLS starts right after connecting and covers data sockets too
+func WithImplicitTLS(config *tls.Config) Option {
+	return func(f *FTPServer) error {
+		if !hasCertificate(config) {
+			return ErrInvalidTLSConfig
+		}
+
+		f.TLSConfig = config
+		f.ImplicitTLS = true
+		return nil
+	}
+}
+
+// Rejects USER and PASS until the control connection uses TLS
+func WithRequireTLS() Option {
+	return func(f *FTPServer) error {
+		f.RequireTLS = true
+		return nil
+	}
+}
+
+// Rejects transfers and listings until the client sent PROT P
+func WithRequireProtectedData() Option {
+	return func(f *FTPServer) error {
+		f.RequireProtectedData = true
+		return nil
+	}
+}
+
+// How long a passive data socket waits for the client to connect
+func WithPassiveTimeout(timeout time.Duration) Option {
+	return func(f *FTPServer) error {
+		f.PassiveTimeout = timeout
+		return nil
+	}
+}
+
+// Limits passive data sockets to a range of ports, inclusive
+func WithPassivePortRange(min int, max int) Option {
+	return func(f *FTPServer) error {
+		if min <= 0 || max > 65535 || min > max {
+			return ErrInvalidPortRange
+		}
+
+		f.PassivePortMin = min
+		f.PassivePortMax = max
+		return nil
+	}
+}
+
+// Interface passive data sockets listen on, defaults to the one the client
+// connected to
+func WithPassiveBindHost(host string) Option {
+	return func(f *FTPServer) error {
+		f.PassiveBindHost = host
+		return nil
+	}
+}
+
+// Address sent in PASV replies, for servers reached through NAT or Docker.
+// Hostnames, e.g. a Docker service name, are resolved to IPv4 on every PASV.
+func WithPassivePublicHost(host string) Option {
+	return func(f *FTPServer) error {
+		f.PassivePublicHost = host
+		return nil
+	}
+}
@@ -0,0 +1,51 @@
+package ftptest
+
+import (
+	"strings"
+)
+
+// Permission is a set of actions a user may perform
+type Permission int
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+	PermRename
+	PermMkDir
+	PermList
+
+	PermNone Permission = 0
+	PermAll             = PermRead | PermWrite | PermDelete | PermRename | PermMkDir | PermList
+)
+
+// Permissions of a user. Paths overrides Default below a path prefix, the
+// longest matching prefix wins. Paths are the ones the user sees.
+type Permissions struct {
+	Default Permission
+	Paths   map[string]Permission
+}
+
+// Checks whether all of the permissions are granted for the path
+func (p *Permissions) Allows(permission Permission, path string) bool {
+	granted := p.Default
+	longest := -1
+
+	for prefix, perm := range p.Paths {
+		if hasPathPrefix(path, prefix) && len(prefix) > longest {
+			granted = perm
+			longest = len(prefix)
+		}
+	}
+
+	return granted&permission == permission
+}
+
+// Like strings.HasPrefix, but only matches whole path elements
+func hasPathPrefix(path string, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
@@ -0,0 +1,54 @@
+package ftptest
+
+import "testing"
+
+func TestDropBoxPermissions(t *testing.T) {
+	server := NewServer(t,
+		WithPermissions("drop", PermNone),
+		WithPathPermissions("drop", "/incoming", PermWrite),
+	)
+	server.Filesystem.MkDir("/incoming")
+	server.Filesystem.WriteFile("/incoming/other", []byte("private"))
+
+	client := dialServer(t, server)
+	client.loginAs("drop", "secret")
+
+	client.upload("STOR /incoming/file", []byte("data"))
+
+	client.cmd(550, "LIST /incoming")
+	client.cmd(550, "RETR /incoming/other")
+	client.cmd(550, "DELE /incoming/other")
+	client.cmd(550, "RNFR /incoming/other")
+	client.cmd(550, "MKD /incoming/dir")
+	client.cmd(550, "STOR /outside")
+	client.cmd(550, "STOU /incoming/../outside")
+}
+
+func TestPermissionsLongestPrefix(t *testing.T) {
+	permissions := &Permissions{
+		Default: PermRead,
+		Paths: map[string]Permission{
+			"/pub":         PermRead | PermList,
+			"/pub/uploads": PermWrite,
+		},
+	}
+
+	tests := []struct {
+		permission Permission
+		path       string
+		allowed    bool
+	}{
+		{PermRead, "/", true},
+		{PermList, "/", false},
+		{PermList, "/pub/file", true},
+		{PermList, "/public", false},
+		{PermWrite, "/pub/uploads/file", true},
+		{PermRead, "/pub/uploads/file", false},
+	}
+
+	for _, test := range tests {
+		if got := permissions.Allows(test.permission, test.path); got != test.allowed {
+			t.Errorf("Allows(%d, %s) = %v, want %v", test.permission, test.path, got, test.allowed)
+		}
+	}
+}
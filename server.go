@@ -2,58 +2,262 @@ package ftptest
 
 import (
 	"bufio"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
 	"net"
-	"strconv"
+	filepath "path"
+	"strings"
+	"sync"
+	"time"
 )
 
+// How often Shutdown checks for connections that finished their transfers
+const shutdownPollInterval = 50 * time.Millisecond
+
 type FTPServer struct {
-	Listener   net.Listener
-	Filesystem *Filesystem
+	Listener      net.Listener
+	Filesystem    *Filesystem
+	Backend       Backend
+	Authenticator Authenticator
+	TLSConfig     *tls.Config
+	ImplicitTLS   bool
+
+	RequireTLS           bool
+	RequireProtectedData bool
+
+	// Commands answered as unknown and left out of FEAT, by upper case name
+	DisabledCommands map[string]bool
+
+	Homes          map[string]string
+	Permissions    map[string]*Permissions
+	Welcome        []string
+	IdleTimeout    time.Duration
+	DataTimeout    time.Duration
+	PassiveTimeout time.Duration
+
+	PassiveBindHost   string
+	PassivePublicHost string
+	PassivePortMin    int
+	PassivePortMax    int
+
+	address string
+
+	mutex       sync.Mutex
+	closed      bool
+	connections map[*Connection]struct{}
 }
 
-// Creates a new FTP server on random port
-func NewFTPServer() (*FTPServer, error) {
-	server := &FTPServer{}
+// Creates a new FTP server, by default on a random port
+func NewFTPServer(opts ...Option) (*FTPServer, error) {
+	server := &FTPServer{
+		Filesystem:    NewFilesystem(),
+		Authenticator: AcceptAuthenticator{},
+		Welcome:       []string{"Welcome to a Go FTPTest server!"},
+		address:       "127.0.0.1:0",
+	}
 
-	address, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		if err := opt(server); err != nil {
+			return nil, err
+		}
+	}
+
+	// Serve the in-memory filesystem unless another backend was chosen
+	if server.Backend == nil {
+		server.Backend = server.Filesystem
 	}
 
-	server.Listener, err = net.ListenTCP("tcp", address)
+	var err error
+	server.Listener, err = net.Listen("tcp", server.address)
 	if err != nil {
 		return nil, err
 	}
 
-	server.Filesystem = &Filesystem{
-		Directories: []string{
-			"/",
-		},
-		Files: map[string]*File{},
+	if server.ImplicitTLS {
+		server.Listener = tls.NewListener(server.Listener, server.TLSConfig)
 	}
+
 	return server, nil
 }
 
+// Whether a command, or an option set through OPTS, was left enabled
+func (f *FTPServer) commandEnabled(name string) bool {
+	return !f.DisabledCommands[strings.ToUpper(name)]
+}
+
+// Directory the user is jailed into, "/" unless configured otherwise
+func (f *FTPServer) homeDirectory(identity Identity) string {
+	if identity.Home != "" {
+		return filepath.Clean("/" + identity.Home)
+	}
+
+	if home, ok := f.Homes[identity.Name]; ok {
+		return filepath.Clean("/" + home)
+	}
+
+	return "/"
+}
+
+// Permissions of the user, everything is allowed unless configured otherwise
+func (f *FTPServer) permissions(identity Identity) *Permissions {
+	if identity.Permissions != nil {
+		return identity.Permissions
+	}
+
+	if permissions, ok := f.Permissions[identity.Name]; ok {
+		return permissions
+	}
+
+	return &Permissions{Default: PermAll}
+}
+
+// Permissions of the user, created with full access when missing
+func (f *FTPServer) userPermissions(user string) *Permissions {
+	if f.Permissions == nil {
+		f.Permissions = map[string]*Permissions{}
+	}
+
+	permissions, ok := f.Permissions[user]
+	if !ok {
+		permissions = &Permissions{Default: PermAll, Paths: map[string]Permission{}}
+		f.Permissions[user] = permissions
+	}
+
+	return permissions
+}
+
 // Address of the server to use in tests
 func (f *FTPServer) Address() string {
-	port := f.Listener.Addr().(*net.TCPAddr).Port
-	return "127.0.0.1:" + strconv.Itoa(port)
+	return f.Listener.Addr().String()
 }
 
-// Run it in a goroutine
+// Run it in a goroutine. Returns ErrServerClosed after Close or Shutdown.
 func (f *FTPServer) Listen() error {
 	for {
 		connection, err := f.Listener.Accept()
 		if err != nil {
+			if f.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
 		handler := &Connection{
 			Connection:       connection,
-			Filesystem:       f.Filesystem,
+			Filesystem:       f.Backend,
 			Buffer:           bufio.NewReader(connection),
+			Root:             "/",
 			WorkingDirectory: "/",
+			TransferType:     TypeBinary,
+			TransferMode:     ModeStream,
+			CompressionLevel: zlib.DefaultCompression,
+			Server:           f,
+			Secure:           f.ImplicitTLS,
+			BufferSizeSet:    f.ImplicitTLS,
+			ProtectedData:    f.ImplicitTLS,
+		}
+
+		if !f.trackConnection(handler) {
+			connection.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer f.untrackConnection(handler)
+			handler.Serve()
+		}()
+	}
+}
+
+// Immediately closes the listener and all active connections
+func (f *FTPServer) Close() error {
+	err := f.closeListener()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for connection := range f.connections {
+		connection.Close()
+	}
+
+	return err
+}
+
+// Stops accepting new connections and waits for in-flight transfers to
+// finish. Idle connections are closed right away. If the context expires
+// first, remaining connections are closed and the context error is returned.
+func (f *FTPServer) Shutdown(ctx context.Context) error {
+	err := f.closeListener()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if f.closeIdleConnections() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return ctx.Err()
+		case <-ticker.C:
 		}
-		go handler.Serve()
 	}
 }
+
+func (f *FTPServer) isClosed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.closed
+}
+
+func (f *FTPServer) closeListener() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return nil
+	}
+
+	f.closed = true
+	return f.Listener.Close()
+}
+
+// Closes connections which are not in the middle of a command and reports
+// whether no connections are left
+func (f *FTPServer) closeIdleConnections() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for connection := range f.connections {
+		connection.closeIfIdle()
+	}
+
+	return len(f.connections) == 0
+}
+
+func (f *FTPServer) trackConnection(connection *Connection) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return false
+	}
+
+	if f.connections == nil {
+		f.connections = map[*Connection]struct{}{}
+	}
+
+	f.connections[connection] = struct{}{}
+	return true
+}
+
+func (f *FTPServer) untrackConnection(connection *Connection) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.connections, connection)
+}
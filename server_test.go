@@ -0,0 +1,157 @@
+package ftptest
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a server without NewServer, so tests can shut it down themselves
+func startServer(t *testing.T, opts ...Option) (*FTPServer, chan error) {
+	t.Helper()
+
+	server, err := NewFTPServer(opts...)
+	if err != nil {
+		t.Fatalf("NewFTPServer: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Listen()
+	}()
+
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server, done
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	server, done := startServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("Listen returned %v, want ErrServerClosed", err)
+	}
+
+	if _, err := client.text.ReadLine(); err == nil {
+		t.Fatal("control connection still open after Shutdown")
+	}
+
+	if _, err := net.Dial("tcp", server.Address()); err == nil {
+		t.Fatal("server still accepts connections after Shutdown")
+	}
+}
+
+func TestShutdownWaitsForTransfers(t *testing.T) {
+	server, done := startServer(t)
+
+	const size = 8 << 20
+	server.Filesystem.WriteContent("/large", SyntheticContent(size))
+
+	client := dialServer(t, server)
+	client.login()
+
+	socket := client.passive()
+	client.cmd(150, "RETR large")
+
+	// Start reading so the transfer is in flight, then shut down
+	buffer := make([]byte, 1024)
+	if _, err := io.ReadFull(socket, buffer); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	rest, err := io.ReadAll(socket)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if received := len(buffer) + len(rest); received != size {
+		t.Fatalf("received %d bytes, want %d", received, size)
+	}
+
+	client.expect(226)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("Listen returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	server, _ := startServer(t)
+	server.Filesystem.WriteContent("/large", SyntheticContent(1<<30))
+
+	client := dialServer(t, server)
+	client.login()
+
+	// The client never reads, so the transfer blocks
+	socket := client.passive()
+	defer socket.Close()
+	client.cmd(150, "RETR large")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := client.text.ReadLine(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("control connection not closed after the context expired")
+			}
+			break
+		}
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	server := NewServer(t, WithWelcome("Hello", "Second line"))
+
+	client := dialServer(t, server)
+	if client.greeting != "Hello\nSecond line" {
+		t.Fatalf("greeting %q", client.greeting)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := NewServer(t, WithIdleTimeout(100*time.Millisecond))
+
+	client := dialServer(t, server)
+	client.expect(421)
+}
+
+func TestListenAddress(t *testing.T) {
+	server := NewServer(t, WithAddress("127.0.0.1:0"))
+
+	if !strings.HasPrefix(server.Address(), "127.0.0.1:") {
+		t.Fatalf("address %s", server.Address())
+	}
+}
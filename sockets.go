@@ -1,8 +1,11 @@
 package ftptest
 
 import (
+	"crypto/tls"
+	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,27 +17,34 @@ type DataSocket interface {
 	Close() error
 }
 
+// Waiting time for a passive connection when no accept timeout is set
+const defaultPassiveTimeout = 2 * time.Second
+
 type ActiveSocket struct {
 	Connection net.Conn
 	Host       string
 	Port       int
+	Timeout    time.Duration
 }
 
-func NewActiveSocket(host string, port int) (DataSocket, error) {
-	addr, err := net.ResolveTCPAddr("tcp", host+":"+strconv.Itoa(port))
+// Connects to the client. A non-zero timeout limits both dialing and the
+// time a single read or write may take. With a TLS config the server side
+// of a TLS connection is run over it.
+func NewActiveSocket(host string, port int, timeout time.Duration, config *tls.Config) (DataSocket, error) {
+	connection, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	connection, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		return nil, err
+	if config != nil {
+		connection = tls.Server(connection, config)
 	}
 
 	socket := &ActiveSocket{}
 	socket.Connection = connection
 	socket.Host = host
 	socket.Port = port
+	socket.Timeout = timeout
 
 	return socket, nil
 }
@@ -48,10 +58,12 @@ func (a *ActiveSocket) GetPort() int {
 }
 
 func (a *ActiveSocket) Read(p []byte) (int, error) {
+	setDeadline(a.Connection, a.Timeout)
 	return a.Connection.Read(p)
 }
 
 func (a *ActiveSocket) Write(p []byte) (int, error) {
+	setDeadline(a.Connection, a.Timeout)
 	return a.Connection.Write(p)
 }
 
@@ -59,29 +71,105 @@ func (a *ActiveSocket) Close() error {
 	return a.Connection.Close()
 }
 
+// Settings for passive data sockets
+type PassiveConfig struct {
+	// How long to wait for the client to connect, once data is transferred
+	AcceptTimeout time.Duration
+	// How long a single read or write may take, zero means no limit
+	Timeout time.Duration
+	// Wraps the accepted connection in TLS when set
+	TLSConfig *tls.Config
+	// Interface to listen on
+	BindHost string
+	// Host sent to the client, defaults to BindHost
+	PublicHost string
+	// Range of ports to listen on, any free port when zero
+	PortMin int
+	PortMax int
+}
+
 type PassiveSocket struct {
-	Connection net.Conn
-	Port       int
+	Host   string
+	Port   int
+	Config PassiveConfig
+
+	listener   net.Listener
+	connection net.Conn
+	err        error
+	accept     sync.Once
+	mutex      sync.Mutex
+	closed     bool
 }
 
-func NewPassiveSocket() (DataSocket, error) {
-	socket := &PassiveSocket{}
+// Opens a listener for the client to connect to. The port is known right
+// away, the client is accepted on the first read or write and the listener
+// is closed afterwards.
+func NewPassiveSocket(config PassiveConfig) (DataSocket, error) {
+	listener, err := listenPassive(config)
+	if err != nil {
+		return nil, err
+	}
 
-	go socket.ListenAndServe()
+	host := config.PublicHost
+	if host == "" {
+		host = config.BindHost
+	}
 
-	for {
-		if socket.GetPort() > 0 {
-			break
+	socket := &PassiveSocket{
+		Host:     host,
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Config:   config,
+		listener: listener,
+	}
+
+	return socket, nil
+}
+
+// IPv4 address of a host, hostnames such as Docker service names are
+// resolved. Nil when the host has no IPv4 address.
+func resolveIPv4(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+
+	for _, ip := range ips {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4
 		}
+	}
+
+	return nil
+}
 
-		time.Sleep(100 * time.Millisecond)
+// Listens on the first free port of the range, starting at a random one so
+// concurrent sockets do not keep colliding
+func listenPassive(config PassiveConfig) (net.Listener, error) {
+	if config.PortMin == 0 && config.PortMax == 0 {
+		return net.Listen("tcp", net.JoinHostPort(config.BindHost, "0"))
 	}
 
-	return socket, nil
+	ports := config.PortMax - config.PortMin + 1
+	offset := rand.Intn(ports)
+
+	for i := 0; i < ports; i++ {
+		port := config.PortMin + (offset+i)%ports
+
+		listener, err := net.Listen("tcp", net.JoinHostPort(config.BindHost, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+
+	return nil, ErrNoPassivePort
 }
 
 func (p *PassiveSocket) GetHost() string {
-	return "127.0.0.1"
+	return p.Host
 }
 
 func (p *PassiveSocket) GetPort() int {
@@ -89,65 +177,91 @@ func (p *PassiveSocket) GetPort() int {
 }
 
 func (p *PassiveSocket) Read(b []byte) (int, error) {
-	if p.waitUntilOpen() == false {
-		return 0, ErrDataSocketUnavailable
+	connection, err := p.open()
+	if err != nil {
+		return 0, err
 	}
 
-	return p.Connection.Read(b)
+	setDeadline(connection, p.Config.Timeout)
+	return connection.Read(b)
 }
 
 func (p *PassiveSocket) Write(b []byte) (int, error) {
-	if p.waitUntilOpen() == false {
-		return 0, ErrDataSocketUnavailable
+	connection, err := p.open()
+	if err != nil {
+		return 0, err
 	}
 
-	return p.Connection.Write(b)
+	setDeadline(connection, p.Config.Timeout)
+	return connection.Write(b)
 }
 
+// Closes the listener and the accepted connection. Safe to call while
+// another goroutine is waiting for the client.
 func (p *PassiveSocket) Close() error {
-	if p.Connection != nil {
-		return p.Connection.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	p.listener.Close()
+
+	if p.connection != nil {
+		return p.connection.Close()
 	}
 
 	return nil
 }
 
-func (p *PassiveSocket) ListenAndServe() {
-	address, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	if err != nil {
-		return
-	}
+// Accepts the client on first use, later calls return the same result
+func (p *PassiveSocket) open() (net.Conn, error) {
+	p.accept.Do(func() {
+		connection, err := p.acceptClient()
 
-	listener, err := net.ListenTCP("tcp", address)
-	if err != nil {
-		return
-	}
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if err == nil && p.closed {
+			connection.Close()
+			err = ErrDataSocketUnavailable
+		}
 
-	p.Port = listener.Addr().(*net.TCPAddr).Port
+		p.connection = connection
+		p.err = err
+	})
 
-	connection, err := listener.AcceptTCP()
-	if err != nil {
-		return
-	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	p.Connection = connection
+	return p.connection, p.err
 }
 
-func (p *PassiveSocket) waitUntilOpen() bool {
-	retries := 0
+func (p *PassiveSocket) acceptClient() (net.Conn, error) {
+	defer p.listener.Close()
 
-	for {
-		if p.Connection != nil {
-			break
-		}
+	timeout := p.Config.AcceptTimeout
+	if timeout == 0 {
+		timeout = defaultPassiveTimeout
+	}
 
-		if retries > 3 {
-			return false
-		}
+	if listener, ok := p.listener.(*net.TCPListener); ok {
+		listener.SetDeadline(time.Now().Add(timeout))
+	}
 
-		time.Sleep(500 * time.Millisecond)
-		retries += 1
+	connection, err := p.listener.Accept()
+	if err != nil {
+		return nil, ErrDataSocketUnavailable
+	}
+
+	if p.Config.TLSConfig != nil {
+		connection = tls.Server(connection, p.Config.TLSConfig)
 	}
 
-	return true
+	return connection, nil
+}
+
+// Pushes the deadline of a data connection forward before each operation
+func setDeadline(connection net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		connection.SetDeadline(time.Now().Add(timeout))
+	}
 }
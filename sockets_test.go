@@ -0,0 +1,271 @@
+package ftptest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Host and port of a 227 reply
+func parsePASV(t testing.TB, message string) (string, int) {
+	t.Helper()
+
+	start := strings.Index(message, "(")
+	end := strings.Index(message, ")")
+	if start < 0 || end < start {
+		t.Fatalf("invalid PASV reply %q", message)
+	}
+
+	parts := strings.Split(message[start+1:end], ",")
+	if len(parts) != 6 {
+		t.Fatalf("invalid PASV reply %q", message)
+	}
+
+	p1, _ := strconv.Atoi(parts[4])
+	p2, _ := strconv.Atoi(parts[5])
+	return strings.Join(parts[:4], "."), p1*256 + p2
+}
+
+func TestPassiveAcceptsOnce(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	host, port := parsePASV(t, client.cmd(227, "PASV"))
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	data, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	client.cmd(150, "RETR file")
+	if got, _ := io.ReadAll(data); string(got) != "data" {
+		t.Fatalf("RETR %q", got)
+	}
+	client.expect(226)
+
+	// The listener is closed once the client connected
+	if second, err := net.Dial("tcp", address); err == nil {
+		second.Close()
+		t.Fatal("passive socket accepted a second connection")
+	}
+
+	// The socket is used up, the next transfer needs a new one
+	client.cmd(425, "RETR file")
+}
+
+func TestPassiveTimeout(t *testing.T) {
+	server := NewServer(t, WithPassiveTimeout(100*time.Millisecond))
+	server.Filesystem.WriteFile("/file", []byte("data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	// Nobody connects to the data port
+	client.cmd(227, "PASV")
+	client.cmd(150, "LIST")
+	client.expect(425)
+
+	client.cmd(229, "EPSV")
+	client.cmd(150, "RETR file")
+	client.expect(425)
+
+	client.cmd(229, "EPSV")
+	client.cmd(150, "STOR upload")
+	client.expect(425)
+}
+
+// Run with -race, clients transfer in parallel
+func TestConcurrentTransfers(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteContent("/large", SyntheticContent(1<<20))
+
+	// Parallel subtests finish before the group returns
+	t.Run("clients", func(t *testing.T) {
+		for i := 0; i < 8; i++ {
+			name := fmt.Sprintf("upload-%d", i)
+
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+
+				client := dialServer(t, server)
+				client.login()
+				client.upload("STOR "+name, []byte(name))
+
+				if got := client.download("RETR large"); len(got) != 1<<20 {
+					t.Errorf("RETR received %d bytes", len(got))
+				}
+
+				client.download("LIST")
+			})
+		}
+	})
+
+	files, err := server.Filesystem.DirContents("/")
+	if err != nil || len(files) != 9 {
+		t.Fatalf("%d files after uploads (%v)", len(files), err)
+	}
+}
+
+// A port nothing listens on at the moment
+func freePort(t testing.TB) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestPassivePortRange(t *testing.T) {
+	port := freePort(t)
+
+	server := NewServer(t, WithPassivePortRange(port, port))
+
+	first := dialServer(t, server)
+	first.login()
+
+	if _, got := parsePASV(t, first.cmd(227, "PASV")); got != port {
+		t.Fatalf("PASV port %d, want %d", got, port)
+	}
+
+	// The only port is taken by the first client
+	second := dialServer(t, server)
+	second.login()
+	second.cmd(425, "PASV")
+	second.cmd(425, "EPSV")
+}
+
+func TestPassivePortRangeValidation(t *testing.T) {
+	for _, ports := range [][2]int{{0, 10}, {20, 10}, {1000, 70000}} {
+		if _, err := NewFTPServer(WithPassivePortRange(ports[0], ports[1])); err != ErrInvalidPortRange {
+			t.Errorf("range %v returned %v, want ErrInvalidPortRange", ports, err)
+		}
+	}
+}
+
+func TestPassivePublicHost(t *testing.T) {
+	tests := map[string]string{
+		"10.1.2.3":  "10.1.2.3",
+		"localhost": "127.0.0.1",
+	}
+
+	for public, want := range tests {
+		server := NewServer(t, WithPassivePublicHost(public))
+
+		client := dialServer(t, server)
+		client.login()
+
+		if host, _ := parsePASV(t, client.cmd(227, "PASV")); host != want {
+			t.Errorf("public host %s advertised as %s, want %s", public, host, want)
+		}
+	}
+}
+
+func TestActiveMode(t *testing.T) {
+	server := NewServer(t)
+	server.Filesystem.WriteFile("/file", []byte("active data"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	commands := []string{
+		fmt.Sprintf("EPRT |1|127.0.0.1|%d|", port),
+		fmt.Sprintf("PORT 127,0,0,1,%d,%d", port/256, port%256),
+	}
+
+	for _, command := range commands {
+		client.cmd(200, "%s", command)
+		client.cmd(150, "RETR file")
+
+		data, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+
+		got, _ := io.ReadAll(data)
+		data.Close()
+		client.expect(226)
+
+		if string(got) != "active data" {
+			t.Fatalf("%s: RETR %q", command, got)
+		}
+	}
+}
+
+func TestEPRTArguments(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(501, "EPRT |1|127.0.0.1|")
+	client.cmd(501, "EPRT |x|127.0.0.1|21|")
+	client.cmd(501, "EPRT |1|127.0.0.1|port|")
+	client.cmd(501, "EPRT |1|127.0.0.1|70000|")
+	client.cmd(522, "EPRT |3|127.0.0.1|21|")
+	client.cmd(522, "EPRT |2|127.0.0.1|21|")
+	client.cmd(501, "PORT 127,0,0,1")
+}
+
+func TestIPv6(t *testing.T) {
+	probe, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available")
+	}
+	probe.Close()
+
+	server := NewServer(t, WithAddress("[::1]:0"))
+	server.Filesystem.WriteFile("/file", []byte("over IPv6"))
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.cmd(425, "PASV")
+	client.cmd(522, "EPSV 1")
+
+	if got := client.download("RETR file"); string(got) != "over IPv6" {
+		t.Fatalf("EPSV RETR %q", got)
+	}
+
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	client.cmd(200, "EPRT |2|::1|%d|", port)
+	client.cmd(150, "RETR file")
+
+	data, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+
+	got, _ := io.ReadAll(data)
+	data.Close()
+	client.expect(226)
+
+	if string(got) != "over IPv6" {
+		t.Fatalf("EPRT RETR %q", got)
+	}
+}
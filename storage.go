@@ -0,0 +1,187 @@
+package ftptest
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Content is the data of a file, opened anew for every download
+type Content interface {
+	Open() (io.ReadSeekCloser, error)
+	Size() int64
+}
+
+// Releaser is implemented by content holding resources, e.g. a temporary
+// file. The Filesystem releases content once no file refers to it anymore.
+type Releaser interface {
+	Release() error
+}
+
+// Releases the content if it holds resources
+func releaseContent(content Content) {
+	if releaser, ok := content.(Releaser); ok {
+		releaser.Release()
+	}
+}
+
+// Storage keeps the data of uploaded files
+type Storage interface {
+	Create() (ContentWriter, error)
+}
+
+// ContentWriter receives an upload, Content is valid once it is closed
+type ContentWriter interface {
+	io.WriteCloser
+	Content() Content
+}
+
+// Content held in memory
+type BytesContent []byte
+
+func (b BytesContent) Open() (io.ReadSeekCloser, error) {
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+func (b BytesContent) Size() int64 {
+	return int64(len(b))
+}
+
+// Keeps uploads in memory, used when a Filesystem has no storage set
+type MemoryStorage struct{}
+
+func (m MemoryStorage) Create() (ContentWriter, error) {
+	return &memoryWriter{}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+}
+
+func (m *memoryWriter) Close() error {
+	return nil
+}
+
+func (m *memoryWriter) Content() Content {
+	return BytesContent(m.Bytes())
+}
+
+// Streams uploads into temporary files in Dir so large uploads do not stay
+// in memory. A file is deleted when it is overwritten or removed, files still
+// in the filesystem are kept, so use t.TempDir() as Dir to clean them up
+// after the test. An empty Dir uses the system default.
+type TempFileStorage struct {
+	Dir string
+}
+
+func (t TempFileStorage) Create() (ContentWriter, error) {
+	file, err := os.CreateTemp(t.Dir, "ftptest-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &tempFileWriter{file: file}, nil
+}
+
+type tempFileWriter struct {
+	file *os.File
+	size int64
+}
+
+func (t *tempFileWriter) Write(p []byte) (int, error) {
+	n, err := t.file.Write(p)
+	t.size += int64(n)
+	return n, err
+}
+
+func (t *tempFileWriter) Close() error {
+	return t.file.Close()
+}
+
+func (t *tempFileWriter) Content() Content {
+	return &fileContent{path: t.file.Name(), size: t.size}
+}
+
+// Content stored in a file on disk
+type fileContent struct {
+	path string
+	size int64
+}
+
+func (f *fileContent) Open() (io.ReadSeekCloser, error) {
+	return os.Open(f.path)
+}
+
+func (f *fileContent) Size() int64 {
+	return f.size
+}
+
+func (f *fileContent) Release() error {
+	return os.Remove(f.path)
+}
+
+// Content of the given size generated on the fly, for download tests with
+// files too large to keep around. Byte i has the value i % 251, a prime, so
+// offsets are easy to verify.
+type SyntheticContent int64
+
+func (s SyntheticContent) Open() (io.ReadSeekCloser, error) {
+	return &syntheticReader{size: int64(s)}, nil
+}
+
+func (s SyntheticContent) Size() int64 {
+	return int64(s)
+}
+
+type syntheticReader struct {
+	size   int64
+	offset int64
+}
+
+func (s *syntheticReader) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	if remaining := s.size - s.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	for i := range p {
+		p[i] = byte((s.offset + int64(i)) % 251)
+	}
+
+	s.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (s *syntheticReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, ErrInvalidOffset
+	}
+
+	if offset < 0 {
+		return 0, ErrInvalidOffset
+	}
+
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *syntheticReader) Close() error {
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (n nopCloser) Close() error {
+	return nil
+}
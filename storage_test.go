@@ -0,0 +1,69 @@
+package ftptest
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSyntheticContent(t *testing.T) {
+	reader, _ := SyntheticContent(1000).Open()
+	defer reader.Close()
+
+	if _, err := reader.Seek(500, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	data, _ := io.ReadAll(reader)
+	if len(data) != 500 || data[0] != byte(500%251) {
+		t.Fatalf("read %d bytes starting with %d", len(data), data[0])
+	}
+}
+
+func TestTempFileStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	filesystem := NewFilesystem()
+	filesystem.Storage = TempFileStorage{Dir: dir}
+
+	server := NewServer(t, WithFilesystem(filesystem))
+
+	tempFiles := func() int {
+		entries, _ := os.ReadDir(dir)
+		return len(entries)
+	}
+
+	client := dialServer(t, server)
+	client.login()
+
+	client.upload("STOR file", []byte("one"))
+	client.upload("STOR file", []byte("two"))
+	client.cmd(350, "REST 1")
+	client.upload("STOR file", []byte("x"))
+	client.upload("APPE file", []byte("y"))
+
+	if got := readFile(t, filesystem, "/file"); got != "txy" {
+		t.Fatalf("stored %q", got)
+	}
+
+	if n := tempFiles(); n != 1 {
+		t.Fatalf("%d temporary files for one file", n)
+	}
+
+	client.cmd(257, "MKD dir")
+	client.upload("STOR dir/file", []byte("data"))
+	client.upload("STOR other", []byte("data"))
+	client.cmd(350, "RNFR other")
+	client.cmd(250, "RNTO file")
+
+	if n := tempFiles(); n != 2 {
+		t.Fatalf("%d temporary files for two files", n)
+	}
+
+	client.cmd(250, "RMD dir")
+	client.cmd(250, "DELE file")
+
+	if n := tempFiles(); n != 0 {
+		t.Fatalf("%d temporary files left after removing everything", n)
+	}
+}
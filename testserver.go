@@ -0,0 +1,44 @@
+package ftptest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// How long the cleanup of NewServer waits for transfers to finish
+const testShutdownTimeout = 5 * time.Second
+
+// Starts a server listening for the duration of a test, similar to
+// httptest.NewServer. It is shut down once the test and all its subtests
+// complete. Use Address() to connect and Filesystem to seed or inspect files.
+func NewServer(t testing.TB, opts ...Option) *FTPServer {
+	t.Helper()
+
+	server, err := NewFTPServer(opts...)
+	if err != nil {
+		t.Fatalf("ftptest: failed to start server: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if err := server.Listen(); err != ErrServerClosed {
+			t.Errorf("ftptest: server stopped unexpectedly: %v", err)
+		}
+	}()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("ftptest: server did not shut down cleanly: %v", err)
+		}
+
+		<-done
+	})
+
+	return server
+}
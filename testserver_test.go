@@ -0,0 +1,23 @@
+package ftptest
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewServerShutsDownAfterTest(t *testing.T) {
+	var address string
+
+	t.Run("server", func(t *testing.T) {
+		server := NewServer(t)
+		address = server.Address()
+
+		client := dialServer(t, server)
+		client.login()
+		client.cmd(257, "PWD")
+	})
+
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Fatal("server still listening after the test")
+	}
+}
@@ -0,0 +1,116 @@
+package ftptest
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestExplicitTLS(t *testing.T) {
+	serverConfig, clientConfig := testCertificate(t)
+
+	server := NewServer(t, WithTLS(serverConfig))
+	server.Filesystem.WriteFile("/file", []byte("secret data"))
+
+	client := dialServer(t, server)
+	client.cmd(503, "PBSZ 0")
+	client.startTLS(clientConfig)
+	client.login()
+
+	client.cmd(503, "PROT P")
+	client.cmd(200, "PBSZ 0")
+	client.cmd(536, "PROT S")
+	client.cmd(200, "PROT P")
+	client.dataTLS = clientConfig
+
+	if got := client.download("RETR file"); string(got) != "secret data" {
+		t.Fatalf("RETR %q", got)
+	}
+
+	client.upload("STOR upload", []byte("uploaded"))
+	if got := readFile(t, server.Filesystem, "/upload"); got != "uploaded" {
+		t.Fatalf("STOR stored %q", got)
+	}
+
+	client.cmd(503, "AUTH TLS")
+}
+
+func TestAuthWithoutTLSConfig(t *testing.T) {
+	server := NewServer(t)
+
+	client := dialServer(t, server)
+	client.cmd(502, "AUTH TLS")
+}
+
+func TestGenerateCertificate(t *testing.T) {
+	certificate, err := GenerateCertificate()
+	if err != nil {
+		t.Fatalf("GenerateCertificate: %v", err)
+	}
+
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := certificate.Leaf.VerifyHostname(host); err != nil {
+			t.Errorf("certificate not valid for %s: %v", host, err)
+		}
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	serverConfig, clientConfig := testCertificate(t)
+
+	server := NewServer(t, WithImplicitTLS(serverConfig))
+	server.Filesystem.WriteFile("/file", []byte("secret data"))
+
+	conn, err := tls.Dial("tcp", server.Address(), clientConfig)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	client := newTestClient(t, conn)
+	client.login()
+
+	// Data connections are protected from the start
+	client.dataTLS = clientConfig
+	if got := client.download("RETR file"); string(got) != "secret data" {
+		t.Fatalf("RETR %q", got)
+	}
+}
+
+func TestTLSOptionsNeedCertificate(t *testing.T) {
+	options := map[string]Option{
+		"WithTLS(nil)":           WithTLS(nil),
+		"WithTLS(empty)":         WithTLS(&tls.Config{}),
+		"WithImplicitTLS(nil)":   WithImplicitTLS(nil),
+		"WithImplicitTLS(empty)": WithImplicitTLS(&tls.Config{}),
+	}
+
+	for name, option := range options {
+		if _, err := NewFTPServer(option); err != ErrInvalidTLSConfig {
+			t.Errorf("%s returned %v, want ErrInvalidTLSConfig", name, err)
+		}
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	serverConfig, clientConfig := testCertificate(t)
+
+	server := NewServer(t, WithTLS(serverConfig), WithRequireTLS(), WithRequireProtectedData())
+	server.Filesystem.WriteFile("/file", []byte("secret data"))
+
+	client := dialServer(t, server)
+	client.cmd(534, "USER test")
+	client.cmd(534, "PASS test")
+
+	client.startTLS(clientConfig)
+	client.login()
+
+	client.cmd(521, "RETR file")
+	client.cmd(521, "LIST")
+
+	client.cmd(200, "PBSZ 0")
+	client.cmd(200, "PROT P")
+	client.dataTLS = clientConfig
+
+	if got := client.download("RETR file"); string(got) != "secret data" {
+		t.Fatalf("RETR %q", got)
+	}
+}